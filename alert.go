@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"./config"
+	"./log"
+)
+
+// 告警通知的内容
+type alertEvent struct {
+	Status      string  `json:"status"` //firing resolved
+	Rule        string  `json:"rule"`
+	Condition   string  `json:"condition"`
+	Endpoint    string  `json:"endpoint"`
+	Path        string  `json:"path"`
+	FilePattern string  `json:"filepattern"`
+	Tag         string  `json:"tag"`
+	Value       float64 `json:"value"`
+	Timestamp   int64   `json:"timestamp"`
+}
+
+// 每条规则对每个关键词的状态
+type alertState struct {
+	hasLast    bool
+	last       float64 //上个周期的值
+	absent     int     //连续没有匹配的周期数
+	firing     bool
+	lastNotify time.Time
+}
+
+var (
+	alertStates = make(map[string]*alertState)
+	alertClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// 每个上报周期结束后检查告警规则, values 的 key 和 keywords 相同, 包括派生指标
+// 这个函数只在上报的 goroutine 中调用, 不需要加锁
+func evaluateAlerts(c *config.Config, values map[string]float64) {
+	if c.Alert == nil {
+		return
+	}
+
+	now := time.Now()
+	for _, rule := range c.Alert.Rules {
+		for _, v := range c.WatchFiles {
+			if rule.Path != "" && rule.Path != v.Path {
+				continue
+			}
+			tags := make([]string, 0, len(v.Keywords)+len(v.Derived))
+			for _, p := range v.Keywords {
+				for _, agg := range p.Aggs {
+					tags = append(tags, p.SeriesName(agg))
+				}
+			}
+			for _, d := range v.Derived {
+				tags = append(tags, d.Tag)
+			}
+			for _, tag := range tags {
+				if tag != rule.Tag {
+					continue
+				}
+
+				// 只检查本次上报的数据, 不同 timer 的数据在不同的时刻上报
+				key := v.Path + v.FilePattern + tag
+				value, ok := values[key]
+				if !ok {
+					continue
+				}
+				stateKey := rule.Name + "|" + key
+				state, ok := alertStates[stateKey]
+				if !ok {
+					state = &alertState{}
+					alertStates[stateKey] = state
+				}
+
+				matched := checkRule(rule, state, value)
+				state.last = value
+				state.hasLast = true
+
+				event := alertEvent{Rule: rule.Name, Condition: rule.Condition, Endpoint: c.Host,
+					Path: v.Path, FilePattern: v.FilePattern, Tag: tag, Value: value, Timestamp: now.Unix()}
+				if matched {
+					// 第一次告警, 或者持续告警超过了重复通知间隔
+					if !state.firing || (rule.Renotify > 0 && now.Sub(state.lastNotify) >= time.Duration(rule.Renotify)*time.Second) {
+						state.firing = true
+						state.lastNotify = now
+						event.Status = "firing"
+						go notifyAlert(c.Alert.Webhook, event)
+					}
+				} else if state.firing {
+					state.firing = false
+					event.Status = "resolved"
+					go notifyAlert(c.Alert.Webhook, event)
+				}
+			}
+		}
+	}
+}
+
+// 判断本周期是否满足告警条件
+func checkRule(rule config.AlertRule, state *alertState, value float64) bool {
+	switch rule.Kind {
+	case "threshold":
+		return compare(value, rule.Op, rule.Threshold)
+	case "rate":
+		// 上个周期为0时无法计算倍数, 不告警
+		if !state.hasLast || state.last == 0 {
+			return false
+		}
+		return compare(value/state.last, rule.Op, rule.Threshold)
+	case "absent":
+		// fillData 会为没有匹配的关键词补0, 所以值为0即认为没有匹配
+		if value == 0 {
+			state.absent++
+		} else {
+			state.absent = 0
+		}
+		return state.absent >= rule.Windows
+	}
+	return false
+}
+
+func compare(value float64, op string, threshold float64) bool {
+	switch op {
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	case "<":
+		return value < threshold
+	case "<=":
+		return value <= threshold
+	case "==":
+		return value == threshold
+	case "!=":
+		return value != threshold
+	}
+	return false
+}
+
+func notifyAlert(webhook string, event alertEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Error("marshal alert event", event, err)
+		return
+	}
+
+	log.Info("alert", event.Status, string(body))
+	resp, err := alertClient.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Error("send alert to", webhook, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		log.Error("send alert to", webhook, fmt.Sprintf("status %d, body: %s", resp.StatusCode, respBody))
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"./config"
+)
+
+func TestCheckRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    config.AlertRule
+		values  []float64
+		matched []bool
+	}{
+		{
+			name:    "threshold",
+			rule:    config.AlertRule{Kind: "threshold", Op: ">", Threshold: 10},
+			values:  []float64{5, 10, 11, 3},
+			matched: []bool{false, false, true, false},
+		},
+		{
+			name:    "threshold equal",
+			rule:    config.AlertRule{Kind: "threshold", Op: ">=", Threshold: 10},
+			values:  []float64{9, 10},
+			matched: []bool{false, true},
+		},
+		{
+			// 第一个周期没有上个周期的值, 上个周期为0时无法计算倍数
+			name:    "rate increase",
+			rule:    config.AlertRule{Kind: "rate", Op: ">", Threshold: 2},
+			values:  []float64{10, 25, 30, 0, 100, 201},
+			matched: []bool{false, true, false, false, false, true},
+		},
+		{
+			name:    "rate decrease",
+			rule:    config.AlertRule{Kind: "rate", Op: "<", Threshold: 0.5},
+			values:  []float64{10, 4, 4, 1},
+			matched: []bool{false, true, false, true},
+		},
+		{
+			name:    "absent",
+			rule:    config.AlertRule{Kind: "absent", Windows: 2},
+			values:  []float64{1, 0, 0, 0, 3, 0},
+			matched: []bool{false, false, true, true, false, false},
+		},
+		{
+			name:    "absent one window",
+			rule:    config.AlertRule{Kind: "absent", Windows: 1},
+			values:  []float64{0, 1},
+			matched: []bool{true, false},
+		},
+	}
+	for _, tt := range tests {
+		state := &alertState{}
+		for i, value := range tt.values {
+			// 和 evaluateAlerts 一样, 检查后记录本周期的值
+			matched := checkRule(tt.rule, state, value)
+			state.last = value
+			state.hasLast = true
+			if matched != tt.matched[i] {
+				t.Errorf("%s: window %d value %v matched = %v, want %v", tt.name, i, value, matched, tt.matched[i])
+			}
+		}
+	}
+}
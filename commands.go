@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sdvdxl/log4go"
+	"github.com/streamrail/concurrent-map"
+
+	"./config"
+	"./log"
+)
+
+// 子命令, 比如 falcon-logdog convert cfg.json cfg.yaml, 返回进程的退出码
+func runCommand(args []string) int {
+	switch args[0] {
+	case "convert":
+		return convertCommand(args[1:])
+	case "validate":
+		return validateCommand(args[1:])
+	case "test":
+		return testCommand(args[1:])
+	}
+	fmt.Fprintln(os.Stderr, "unknown command", args[0])
+	fmt.Fprintln(os.Stderr, "usage: falcon-logdog [flags] [convert <from> <to> | validate [config] | test [--config cfg.json] [--file sample.log]]")
+	return 2
+}
+
+// 转换配置文件的格式, 格式由扩展名决定, to 为 - 时输出到标准输出
+func convertCommand(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: falcon-logdog convert <from> <to>")
+		return 2
+	}
+	from, to := args[0], args[1]
+
+	data, err := ioutil.ReadFile(from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// 先检查能否解析, 避免转换出无法使用的配置, 环境变量保留原样, 不需要运行时的环境变量
+	if _, err = config.DecodeTemplate(data, config.FileFormat(from)); err != nil {
+		fmt.Fprintln(os.Stderr, from, err)
+		return 1
+	}
+
+	if data, err = config.ToJSON(data, config.FileFormat(from)); err == nil {
+		format := config.FormatYAML
+		if to != "-" {
+			format = config.FileFormat(to)
+		}
+		data, err = config.FromJSON(data, format)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if to == "-" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err = ioutil.WriteFile(to, data, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// 校验配置文件, 输出所有的错误和警告, 有错误时退出码为 1, 可以在 CI 中使用
+func validateCommand(args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "usage: falcon-logdog validate [config]")
+		return 2
+	}
+	file := config.ConfigFile
+	if len(args) == 1 {
+		file = args[0]
+	}
+
+	// 只输出校验结果, 不输出读取配置时的日志
+	stdlog.SetOutput(ioutil.Discard)
+	errs, warnings := 0, 0
+	for _, p := range config.ValidateConfig(file) {
+		fmt.Println(p)
+		if p.Warning {
+			warnings++
+		} else {
+			errs++
+		}
+	}
+	fmt.Printf("%s: %d errors, %d warnings\n", file, errs, warnings)
+	if errs > 0 {
+		return 1
+	}
+	return 0
+}
+
+// 用配置中的关键词匹配样例日志, 输出每一行匹配到的关键词和数字, 最后输出一个周期统计出的数据.
+// 统计使用和运行时相同的 handleKeywords, 整个样例作为一个周期, rate 按照一个完整的周期计算
+func testCommand(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfgFile := flags.String("config", config.ConfigFile, "configuration file")
+	sample := flags.String("file", "", "sample log file, read from stdin if not set")
+	path := flags.String("path", "", "only use keywords of the watch file with this path")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	stdlog.SetOutput(ioutil.Discard)
+	log.SetLevel(log4go.ERROR)
+	c, err := config.ReadConfig(*cfgFile)
+	if err == nil {
+		err = config.CheckConfig(c)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// 不输出日志行, 也不保留样本
+	c.Samples = 0
+	files := make([]*config.WatchFile, 0, len(c.WatchFiles))
+	for _, v := range c.WatchFiles {
+		if *path != "" && v.Path != *path {
+			continue
+		}
+		for i := range v.Keywords {
+			v.Keywords[i].Capture = nil
+		}
+		files = append(files, v)
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "no watch file with path", *path)
+		return 1
+	}
+	config.Cfg = c
+	keywords = cmap.New()
+
+	var input io.Reader = os.Stdin
+	if *sample != "" {
+		f, err := os.Open(*sample)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		input = f
+	}
+
+	total, matched := 0, 0
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		total++
+		results := make([]string, 0)
+		for _, v := range files {
+			for _, p := range v.Keywords {
+				if groups := p.Regex.FindStringSubmatch(line); groups != nil {
+					results = append(results, matchResult(v, p, groups))
+				}
+			}
+			handleKeywords(*v, line)
+		}
+		if len(results) == 0 {
+			continue
+		}
+		matched++
+		fmt.Printf("%d: %s\n", total, line)
+		for _, r := range results {
+			fmt.Println("    " + r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%d lines, %d matched\n\n", total, matched)
+
+	// 周期结束的时刻是所有 timer 的公倍数, 所有的数据都会被取出
+	end := int64(1)
+	for _, step := range c.Timers() {
+		end = lcm(end, int64(step))
+	}
+	end = time.Now().Unix() / end * end
+	data, values := collectData(end, func(key string, step int) float64 {
+		return float64(step)
+	})
+	data = append(data, derivedData(c, values, end)...)
+	sort.Slice(data, func(i, j int) bool {
+		return data[i].Tags < data[j].Tags
+	})
+	for _, d := range data {
+		bytes, _ := json.Marshal(d)
+		fmt.Println(string(bytes))
+	}
+	return 0
+}
+
+// 一个关键词匹配的结果, 需要数字的统计方式会显示第一个分组解析出的数字
+func matchResult(file *config.WatchFile, p config.KeyWord, groups []string) string {
+	result := file.Path + " " + p.Tag + ": " + strconv.Quote(groups[0])
+	if len(groups) < 2 {
+		return result
+	}
+	numeric := false
+	for _, agg := range p.Aggs {
+		if agg != "count" && agg != "distinct" && agg != "topk" {
+			numeric = true
+		}
+	}
+	if !numeric {
+		return result + " group=" + strconv.Quote(groups[1])
+	}
+	if value, err := strconv.ParseFloat(groups[1], 64); err == nil {
+		return result + " value=" + strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return result + " group=" + strconv.Quote(groups[1]) + " (not a number, ignored)"
+}
+
+func lcm(a int64, b int64) int64 {
+	x, y := a, b
+	for y != 0 {
+		x, y = y, x%y
+	}
+	return a / x * b
+}
@@ -1,14 +1,17 @@
 package config
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/go-errors/errors"
 	"github.com/hpcloud/tail"
 	"io/ioutil"
 	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"path/filepath"
 	"log"
@@ -19,8 +22,64 @@ type Config struct {
 	Timer      int         `json:"timer"` // 每隔多长时间（秒）上报
 	Host       string      `json:"host"` //主机名称
 	Agent      string      `json:"agent"` //agent api url
-	WatchFiles []WatchFile `json:"files"`
+	WatchFiles []*WatchFile `json:"files"`
 	LogLevel   string
+	Retry      int         `json:"retry"`       //推送失败后的重试次数,默认3次,负数表示不重试
+	DeadLetter string      `json:"dead_letter"` //重试失败或agent拒收的数据追加写入的文件,为空则丢弃
+	BatchSize  int         `json:"batch_size"`  //每次推送最多的数据条数,默认1000
+	BatchBytes int         `json:"batch_bytes"` //每次推送最大的字节数(压缩前),默认1MB
+	Gzip       bool        `json:"gzip"`        //是否使用gzip压缩推送内容
+	FileSink   *FileSink   `json:"file_sink"`   //本地文件输出
+	LineSink   *LineSink   `json:"line_sink"`   //匹配到的日志行的输出
+	Samples    int         `json:"samples"`     //每个关键词在内存中保留最近匹配到的行数,默认100,负数表示不保留
+	Alert      *Alert      `json:"alert"`       //本地告警
+	StateFile  string      `json:"state_file"`  //保存 COUNTER 累计值的文件,默认 state-dir 目录下的 counters.json
+	DropPathTags bool      `json:"drop_path_tags"` //所有数据的 tags 中都不加 path 和 filepattern
+	Include    string      `json:"include"`     //监控文件配置片段的目录,相对路径相对于配置文件所在的目录
+	IncludeDir string      `json:"-"`           //include 的实际路径, 热更新时监控这个目录
+	source     string      //配置文件的路径, 用于报告配置的问题
+}
+
+type Alert struct {
+	Webhook  string      `json:"webhook"`  //告警和恢复通知 POST 的地址
+	Renotify int         `json:"renotify"` //持续告警时重复通知的间隔(秒),默认3600,负数表示不重复通知
+	Rules    []AlertRule `json:"rules"`
+}
+
+type AlertRule struct {
+	Name      string  `json:"name"`      //规则名称,默认为 tag + 条件
+	Tag       string  `json:"tag"`       //关键词的tag
+	Path      string  `json:"path"`      //只检查这个路径的关键词,为空则检查所有相同tag的关键词
+	Condition string  `json:"condition"` //"> 10", "rate > 2x last window", "absent for 3 windows"
+	Renotify  int     `json:"renotify"`  //覆盖 alert 的 renotify
+	Kind      string  `json:"-"`         //threshold rate absent
+	Op        string  `json:"-"`         //比较运算符
+	Threshold float64 `json:"-"`         //阈值或者倍数
+	Windows   int     `json:"-"`         //absent 的周期数
+}
+
+type LineSink struct {
+	Type       string `json:"type"`        //file webhook syslog
+	Path       string `json:"path"`        //file: 输出文件
+	MaxSize    int64  `json:"max_size"`    //file: 文件超过这个大小(字节)后滚动, 默认100MB
+	MaxBackups int    `json:"max_backups"` //file: 保留的滚动文件个数, 默认5个, 负数表示不保留
+	Url        string `json:"url"`         //webhook: POST 地址
+	Network    string `json:"network"`     //syslog: udp tcp, 为空则使用本机syslog
+	Address    string `json:"address"`     //syslog: 地址, 比如 127.0.0.1:514
+}
+
+type FileSink struct {
+	Path       string `json:"path"`        //输出文件
+	Format     string `json:"format"`      //json 或 csv, 默认json
+	MaxSize    int64  `json:"max_size"`    //文件超过这个大小(字节)后滚动, 默认100MB
+	MaxBackups int    `json:"max_backups"` //保留的滚动文件个数, 默认5个, 负数表示不保留
+}
+
+// path 还不存在时由等待它出现的 goroutine 修改, 其它 goroutine 通过 IsPending 和 IsFile 读取
+type watchState struct {
+	sync.RWMutex
+	pending    bool //path 还不存在, 出现后才开始监控
+	pathIsFile bool //path 是否是文件
 }
 
 type resultFile struct {
@@ -33,19 +92,116 @@ type WatchFile struct {
 	Path       string 	`json:"path"`//路径
 	FilePattern  string		`json:"filepattern"`
 	FilePatternExp *regexp.Regexp `json:"-"`
-	Keywords   []keyWord	`json:"keywords"`
-	PathIsFile bool       //path 是否是文件
-	ResultFile resultFile `json:"-"`
+	Keywords   []KeyWord	`json:"keywords"`
+	ResultFile *resultFile `json:"-"`
 	Close_chan chan bool `json:"-"`
+	live       *atomic.Value //当前生效的 *WatchFile, 热更新时在新旧配置之间共享
+	Derived    []Derived `json:"derived"` //由关键词计算出来的指标
+	Metric     string            `json:"metric"`         //覆盖全局的 metric
+	Tags       map[string]string `json:"tags"`           //静态tag, 加到这个文件所有数据的 tags 中
+	DropPathTags bool            `json:"drop_path_tags"` //tags 中不加 path 和 filepattern
+	Timer        int               `json:"timer"`          //覆盖全局的 timer, 这个文件的数据按照这个周期上报
+	StaticTags string            `json:"-"`              //排序后的静态tag, 比如 ",k1=v1,k2=v2"
+	state      *watchState       //path 是否存在以及是否是文件, 热更新时在新旧配置之间共享
+	origin     origin            //所在的配置文件和位置, 用于报告配置的问题
+}
+
+// 所有用到的上报周期
+func (c *Config) Timers() []int {
+	timers := []int{c.Timer}
+	seen := map[int]bool{c.Timer: true}
+	for _, v := range c.WatchFiles {
+		if !seen[v.Timer] {
+			seen[v.Timer] = true
+			timers = append(timers, v.Timer)
+		}
+		for _, keyword := range v.Keywords {
+			if !seen[keyword.Timer] {
+				seen[keyword.Timer] = true
+				timers = append(timers, keyword.Timer)
+			}
+		}
+	}
+	return timers
+}
+
+// 等待中的路径出现后, 判断是文件还是目录并查找要监控的日志文件
+func (w *WatchFile) Activate() error {
+	info, err := os.Stat(w.Path)
+	if err != nil {
+		return err
+	}
+	w.state.Lock()
+	w.state.pathIsFile = !info.IsDir()
+	w.state.pending = false
+	w.state.Unlock()
+	return SetLogFile(&Config{WatchFiles: []*WatchFile{w}})
+}
+
+// 配置热更新时 path 和 filepattern 没有变化的文件由新的配置接管正在运行的 tail,
+// ResultFile, Close_chan 和 state 使用旧配置的, 旧的 WatchFile 不会被修改, 正在读取它的 goroutine 不受影响
+func (w *WatchFile) TakeOver(old *WatchFile) {
+	w.ResultFile = old.ResultFile
+	w.Close_chan = old.Close_chan
+	w.state = old.state
+	w.live = old.live
+	w.live.Store(w)
+}
+
+// path 是否还不存在
+func (w *WatchFile) IsPending() bool {
+	w.state.RLock()
+	defer w.state.RUnlock()
+	return w.state.pending
+}
+
+// path 是否是文件, 不是文件时监控目录中匹配 filepattern 的文件
+func (w *WatchFile) IsFile() bool {
+	w.state.RLock()
+	defer w.state.RUnlock()
+	return w.state.pathIsFile
+}
+
+// 当前生效的配置, tail 的 goroutine 每行读取一次, 返回的 WatchFile 不能修改
+func (w *WatchFile) Current() *WatchFile {
+	if w.live == nil {
+		return w
+	}
+	return w.live.Load().(*WatchFile)
+}
+
+type Derived struct {
+	Tag        string   `json:"tag"`
+	Expression string   `json:"expr"`     //四则运算表达式, 比如 error / total * 100
+	DivZero    *float64 `json:"div_zero"` //除数为0时上报的值, 不设置则本周期不上报
+	Expr       Expr     `json:"-"`
+	origin     origin
 }
 
 
-type keyWord struct {
+type KeyWord struct {
 	Exp      string		`json:"exp"`
 	Tag      string		`json:"tag"`
 	Type     string		`json:"type"`
+	Types    []string       `json:"types"` //同一个正则表达式的多种统计方式, 每种统计方式上报一条数据, tags 加上 agg=统计方式
+	Aggs     []string       `json:"-"`     //实际使用的统计方式, 只设置了 type 时为 [type]
 	FixedExp string         `json:"-"` //替换
 	Regex    *regexp.Regexp `json:"-"`
+	Capture  *LineCapture   `json:"capture"` //把匹配到的日志行输出到 line_sink
+	CounterType string      `json:"counter_type"` //GAUGE 或 COUNTER, 默认GAUGE, COUNTER 上报跨周期的累计值
+	DistinctThreshold int   `json:"distinct_threshold"` //distinct: 精确计数的最大数量, 超过后使用 HyperLogLog 估算, 默认10000
+	TopK         int        `json:"topk"`          //topk: 上报计数最多的前几个值, 默认10
+	TopKCapacity int        `json:"topk_capacity"` //topk: 统计时最多保留的值的个数, 越大越准确, 默认topk的10倍
+	Metric       string            `json:"metric"` //覆盖文件和全局的 metric
+	Timer        int               `json:"timer"`  //覆盖文件和全局的 timer
+	Tags         map[string]string `json:"tags"`   //静态tag, 和文件的静态tag合并, 相同的key使用这里的值
+	StaticTags   string            `json:"-"`
+	origin       origin
+}
+
+type LineCapture struct {
+	Rate      int `json:"rate"`       //每秒最多输出的行数, 默认10
+	MaxLength int `json:"max_length"` //每行最大长度, 超过会被截断, 默认1024
 }
 
 //说明：这7个字段都是必须指定
@@ -63,14 +219,25 @@ type PushData struct {
 	//COUNTER：指标在存储和展现的时候，会被计算为speed，即（当前值 - 上次值）/ 时间间隔
 	Tags string `json:"tags"` //一组逗号分割的键值对, 对metric进一步描述和细化, 可以是空字符串. 比如idc=lg，比如service=xbox等，多个tag之间用逗号分割
 	Count int `json:"-"`  // 辅助变量  用于求平均数
+	Type  string `json:"-"` // 辅助变量  关键词的统计方式
+	Mean  float64 `json:"-"` // 辅助变量  用于求方差, 当前的平均数
+	M2    float64 `json:"-"` // 辅助变量  用于求方差, 与平均数之差的平方和
 }
 
-const ConfigFile = "./cfg.json"
+// 启动参数, 可以通过 -c 和 -state-dir 指定
+var (
+	ConfigFile = "./cfg.json" // 配置文件
+	StateDir   = "var"        // 保存状态文件的目录
+)
 
 var (
-	Cfg         *Config
-	fixExpRegex = regexp.MustCompile(`[\W]+`)
-	Tem_cfg		*Config
+	Cfg             *Config
+	fixExpRegex     = regexp.MustCompile(`[\W]+`)
+	thresholdRegex  = regexp.MustCompile(`^(>=|<=|==|!=|>|<)\s*(-?[0-9.]+)$`)
+	rateRegex       = regexp.MustCompile(`^rate\s*(>=|<=|>|<)\s*([0-9.]+)x(\s+last\s+window)?$`)
+	absentRegex     = regexp.MustCompile(`^absent\s+for\s+([0-9]+)\s+windows?$`)
+	percentileRegex = regexp.MustCompile(`^p[0-9]+(\.[0-9]+)?$`)
+	Tem_cfg         *Config
 )
 
 
@@ -101,6 +268,11 @@ func Init_config() error {
 }
 
 func ReadConfig(configFile string) (*Config, error) {
+	return readConfig(configFile, nil)
+}
+
+// unset 不为 nil 时没有设置的环境变量不报错, 记录到 unset 中
+func readConfig(configFile string, unset map[string]bool) (*Config, error) {
 	var config *Config
 	//config = new(Config)
 	bytes, err := ioutil.ReadFile(configFile)
@@ -108,93 +280,555 @@ func ReadConfig(configFile string) (*Config, error) {
 		return config, err
 	}
 
-	if err := json.Unmarshal(bytes, &config); err != nil {
-		return config, err
+	// 根据扩展名使用 json, yaml 或者 toml 格式
+	if config, err = decodeConfig(bytes, FileFormat(configFile), true, unset); err != nil {
+		return config, fmt.Errorf("%s: %v", configFile, err)
 	}
 
-	fmt.Println(config.LogLevel)
+	// 合并 include 目录中的监控文件
+	if err = includeFiles(config, configFile, unset); err != nil {
+		return config, err
+	}
 
 	log.Println("config init success, start to work ...")
 	return config, nil
 }
 
-// 检查配置项目是否正确
+// 检查配置并设置默认值, 警告只输出到日志, 有错误时返回所有的错误
 func CheckConfig(config *Config) error {
+	errs := make([]string, 0)
+	for _, p := range checkConfig(config) {
+		if p.Warning {
+			log.Println("WARNING:", p.location())
+			continue
+		}
+		errs = append(errs, p.location())
+	}
+	if len(errs) > 0 {
+		return errors.New("ERROR: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// 检查配置并设置默认值, 返回所有的错误和可能有问题的配置, validate 子命令也使用这里的结果
+func checkConfig(config *Config) []Problem {
+	v := &validator{}
+	global := origin{source: config.source}
 	var err error
 	//检查 host
 	if config.Host == "" {
 		if config.Host, err = os.Hostname(); err != nil {
-			return err
+			v.errorf(global, "host", "%v", err)
 		}
 
 		log.Println("host not set will use system's name:", config.Host)
 
 	}
 
-	for i, v := range config.WatchFiles {
-		//检查路径
-		fInfo, err := os.Stat(v.Path)
-		if err != nil {
-			return err
+	//检查上报周期
+	if config.Timer <= 0 {
+		v.errorf(global, "timer", "must be positive")
+	}
+
+	//检查重试次数
+	if config.Retry > 10 {
+		v.warnf(global, "retry", "%d retries may delay the next push", config.Retry)
+	}
+	if config.Retry == 0 {
+		config.Retry = 3
+	} else if config.Retry < 0 {
+		config.Retry = 0
+	}
+
+	//检查输出
+	if config.Agent == "" && config.FileSink == nil {
+		v.errorf(global, "agent", "agent or file_sink must be set")
+	}
+	if config.FileSink != nil {
+		if config.FileSink.Path == "" {
+			v.errorf(global, "file_sink.path", "is required")
 		}
-		log.Println(v.Path)
-		if os.IsNotExist(err) {
-			return err
+		if config.FileSink.Format == "" {
+			config.FileSink.Format = "json"
+		}
+		if config.FileSink.Format != "json" && config.FileSink.Format != "csv" {
+			v.errorf(global, "file_sink.format", "must be json or csv, got %q", config.FileSink.Format)
+		}
+		if config.FileSink.MaxSize <= 0 {
+			config.FileSink.MaxSize = 100 * 1024 * 1024
+		}
+		if config.FileSink.MaxBackups == 0 {
+			config.FileSink.MaxBackups = 5
+		} else if config.FileSink.MaxBackups < 0 {
+			config.FileSink.MaxBackups = 0
 		}
+	}
+
+	if config.LineSink != nil {
+		switch config.LineSink.Type {
+		case "file":
+			if config.LineSink.Path == "" {
+				v.errorf(global, "line_sink.path", "is required")
+			}
+			if config.LineSink.MaxSize <= 0 {
+				config.LineSink.MaxSize = 100 * 1024 * 1024
+			}
+			if config.LineSink.MaxBackups == 0 {
+				config.LineSink.MaxBackups = 5
+			} else if config.LineSink.MaxBackups < 0 {
+				config.LineSink.MaxBackups = 0
+			}
+		case "webhook":
+			if config.LineSink.Url == "" {
+				v.errorf(global, "line_sink.url", "is required")
+			}
+		case "syslog":
+			if config.LineSink.Network != "" && config.LineSink.Address == "" {
+				v.errorf(global, "line_sink.address", "is required")
+			}
+		default:
+			v.errorf(global, "line_sink.type", "must be file, webhook or syslog, got %q", config.LineSink.Type)
+		}
+	}
+
+	if config.StateFile == "" {
+		config.StateFile = filepath.Join(StateDir, "counters.json")
+	}
+
+	if config.Samples == 0 {
+		config.Samples = 100
+	} else if config.Samples < 0 {
+		config.Samples = 0
+	}
+
+	//检查推送批次大小
+	if config.BatchSize < 0 {
+		v.errorf(global, "batch_size", "can not be negative")
+	} else if config.BatchSize == 0 {
+		config.BatchSize = 1000
+	}
+	if config.BatchBytes < 0 {
+		v.errorf(global, "batch_bytes", "can not be negative")
+	} else if config.BatchBytes == 0 {
+		config.BatchBytes = 1024 * 1024
+	}
 
-		if !fInfo.IsDir() {
-			config.WatchFiles[i].PathIsFile = true
+	for i, w := range config.WatchFiles {
+		// 通过 include 合并的文件记录了所在的配置片段, 其它的按照在配置文件中的位置
+		at := origin{source: config.source, path: fmt.Sprintf("files[%d]", i)}
+		if w == nil {
+			v.errorf(at, "", "can not be null")
+			continue
+		}
+		if w.origin.path == "" {
+			w.origin = at
 		}
+		checkFile(v, config, w, w.origin)
+	}
+	checkSeries(v, config)
+
+	if config.Alert != nil {
+		checkAlert(v, config, global)
+	}
 
-		config.WatchFiles[i].Close_chan = make(chan bool)
+	return v.problems
+}
+
+func checkFile(v *validator, config *Config, w *WatchFile, at origin) {
+	var err error
+	//检查路径, 还不存在的路径等它出现后再开始监控
+	dir := false
+	w.state = &watchState{}
+	if w.Path == "" {
+		v.errorf(at, "path", "is required")
+	} else if fInfo, err := os.Stat(w.Path); os.IsNotExist(err) {
+		v.warnf(at, "path", "%s does not exist yet, will be watched when created", w.Path)
+		w.state.pending = true
+	} else if err != nil {
+		v.errorf(at, "path", "%v", err)
+	} else if !fInfo.IsDir() {
+		w.state.pathIsFile = true
+	} else {
+		dir = true
+	}
+	log.Println(w.Path)
 
+	w.Close_chan = make(chan bool)
+	w.ResultFile = &resultFile{}
+	w.live = &atomic.Value{}
+	w.live.Store(w)
 
-		if config.WatchFiles[i].FilePattern == "" {
-			log.Println("file pre ", config.WatchFiles[i].Path, "filematch is no set, will use \\.*")
-			config.WatchFiles[i].FilePattern = "\\.*"
-			// errors.New("ERROR: filematch must set ")
+	if w.FilePattern == "" {
+		if dir {
+			v.warnf(at, "filepattern", "not set, any file in %s may be watched", w.Path)
 		}
-		if config.WatchFiles[i].FilePatternExp, err = regexp.Compile(config.WatchFiles[i].FilePattern); err != nil {
-			return err
+		w.FilePattern = "\\.*"
+	}
+	if w.FilePatternExp, err = regexp.Compile(w.FilePattern); err != nil {
+		v.errorf(at, "filepattern", "invalid regex: %v", err)
+	}
+
+	//检查keywords
+	if len(w.Keywords) == 0 {
+		v.errorf(at, "keywords", "at least one keyword is required")
+	}
+
+	//检查 metric timer 和静态tag, 关键词的配置覆盖文件的配置, 文件的配置覆盖全局的配置
+	if w.Metric == "" {
+		w.Metric = config.Metric
+	}
+	if w.Timer < 0 {
+		v.errorf(at, "timer", "can not be negative")
+	} else if w.Timer == 0 {
+		w.Timer = config.Timer
+	}
+	w.DropPathTags = w.DropPathTags || config.DropPathTags
+	if w.StaticTags, err = staticTags(w.Tags); err != nil {
+		v.errorf(at, "tags", "%s", strings.TrimPrefix(err.Error(), "ERROR: "))
+	}
+
+	for j := range w.Keywords {
+		if w.Keywords[j].origin.path == "" {
+			w.Keywords[j].origin = origin{source: at.source, path: fmt.Sprintf("%s.keywords[%d]", at.path, j)}
 		}
+		checkKeyword(v, config, w, &w.Keywords[j], w.Keywords[j].origin)
+	}
 
-		//检查keywords
-		if len(v.Keywords) == 0 {
-			return errors.New("ERROR: keyword list not set")
+	//检查派生指标
+	checkDerived(v, w, at)
+}
+
+func checkKeyword(v *validator, config *Config, w *WatchFile, keyword *KeyWord, at origin) {
+	var err error
+	if keyword.Metric == "" {
+		keyword.Metric = w.Metric
+	}
+	if keyword.Timer < 0 {
+		v.errorf(at, "timer", "can not be negative")
+	} else if keyword.Timer == 0 {
+		keyword.Timer = w.Timer
+	}
+	if keyword.StaticTags, err = staticTags(w.Tags, keyword.Tags); err != nil {
+		v.errorf(at, "tags", "%s", strings.TrimPrefix(err.Error(), "ERROR: "))
+	}
+
+	if keyword.Tag == "" {
+		v.errorf(at, "tag", "is required")
+	}
+	// 设置正则表达式
+	if keyword.Exp == "" {
+		v.errorf(at, "exp", "is required")
+	} else if keyword.Regex, err = regexp.Compile(keyword.Exp); err != nil {
+		v.errorf(at, "exp", "invalid regex: %v", err)
+	} else {
+		if keyword.Regex.MatchString("") {
+			v.warnf(at, "exp", "matches empty string, every line will match")
+		} else if strings.HasPrefix(keyword.Exp, ".*") {
+			v.warnf(at, "exp", "leading .* is not needed and makes matching slower")
 		}
+		log.Println("INFO: tag:", keyword.Tag, "regex", keyword.Regex.String())
+	}
+	keyword.FixedExp = string(fixExpRegex.ReplaceAll([]byte(keyword.Exp), []byte(".")))
+
+	// type 和 types 只能设置一个, 统一放到 Aggs 中
+	field := "type"
+	if keyword.Type != "" && len(keyword.Types) > 0 {
+		v.errorf(at, "types", "type and types can not both be set")
+	}
+	if len(keyword.Types) > 0 {
+		keyword.Aggs = keyword.Types
+		field = "types"
+	} else if keyword.Type == "" {
+		keyword.Type = "count"
+		keyword.Aggs = []string{"count"}
+	} else {
+		keyword.Aggs = []string{keyword.Type}
+	}
 
-		for i, keyword := range v.Keywords {
-			if keyword.Exp == "" || keyword.Tag == "" {
-				return errors.New("ERROR: keyword's exp and tag are requierd")
+	if keyword.CounterType == "" {
+		keyword.CounterType = "GAUGE"
+	}
+	if keyword.CounterType != "GAUGE" && keyword.CounterType != "COUNTER" {
+		v.errorf(at, "counter_type", "must be GAUGE or COUNTER, got %q", keyword.CounterType)
+	}
+
+	for _, agg := range keyword.Aggs {
+		if !IsAggType(agg) {
+			v.errorf(at, field, "unknown type %q", agg)
+			continue
+		}
+		if keyword.Regex != nil && keyword.Regex.NumSubexp() == 0 && needsGroup(agg) {
+			v.warnf(at, "exp", "type %s needs a group in exp, lines will be ignored", agg)
+		}
+		// 只有可以累加的类型才能使用 COUNTER
+		if keyword.CounterType == "COUNTER" && agg != "count" && agg != "sum" {
+			v.errorf(at, "counter_type", "COUNTER only supports count and sum, got %s", agg)
+		}
+		if agg == "topk" {
+			if keyword.TopK <= 0 {
+				keyword.TopK = 10
 			}
-			if keyword.Type == "" {
-				v.Keywords[i].Type = "count"
+			if keyword.TopKCapacity < keyword.TopK {
+				keyword.TopKCapacity = keyword.TopK * 10
 			}
-			keyword.Type = v.Keywords[i].Type
-			if keyword.Type != "count" && keyword.Type != "avg" && keyword.Type != "min" && keyword.Type != "max" && keyword.Type != "sum" {
-				return errors.New("ERROR: keyword Type must in count avg min max")
+		}
+		if agg == "distinct" && keyword.DistinctThreshold <= 0 {
+			keyword.DistinctThreshold = 10000
+		}
+	}
+
+	if keyword.Capture != nil {
+		if config.LineSink == nil {
+			v.errorf(at, "capture", "line_sink must be set")
+		}
+		if keyword.Capture.Rate <= 0 {
+			keyword.Capture.Rate = 10
+		}
+		if keyword.Capture.MaxLength <= 0 {
+			keyword.Capture.MaxLength = 1024
+		}
+	}
+}
+
+// 关键词每种统计方式对应的名称, 使用 types 时为 tag.统计方式, 派生指标和告警规则使用这个名称
+func (k KeyWord) SeriesName(agg string) string {
+	if len(k.Types) == 0 {
+		return k.Tag
+	}
+	return k.Tag + "." + agg
+}
+
+// 上报时的 tags
+func (k KeyWord) SeriesTags(file WatchFile, agg string) string {
+	if len(k.Types) > 0 {
+		return file.SeriesTags(k.Tag, ",agg="+agg+k.StaticTags)
+	}
+	return file.SeriesTags(k.Tag, k.StaticTags)
+}
+
+// 上报时的 tags, static 是静态tag
+func (file WatchFile) SeriesTags(tag string, static string) string {
+	tags := "tag=" + tag + static
+	if !file.DropPathTags {
+		tags = "path=" + file.Path + ",filepattern=" + file.FilePattern + "," + tags
+	}
+	return tags
+}
+
+// 合并静态tag, 后面的覆盖前面的, 返回按key排序后的 ",k1=v1,k2=v2"
+func staticTags(maps ...map[string]string) (string, error) {
+	merged := make(map[string]string)
+	for _, m := range maps {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+
+	keys := make([]string, 0, len(merged))
+	for k, v := range merged {
+		switch k {
+		case "path", "filepattern", "tag", "agg", "rank", "value":
+			return "", errors.New("ERROR: static tag key is reserved: " + k)
+		}
+		if k == "" || strings.ContainsAny(k, ",= ") || strings.ContainsAny(v, ",= ") {
+			return "", errors.New("ERROR: static tag can not be empty or contain ',' '=' ' ': " + k + "=" + v)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	result := ""
+	for _, k := range keys {
+		result += "," + k + "=" + merged[k]
+	}
+	return result, nil
+}
+
+// 是否是支持的统计方式
+func IsAggType(agg string) bool {
+	switch agg {
+	case "count", "avg", "min", "max", "sum", "rate", "distinct", "topk", "last", "first", "stddev", "variance":
+		return true
+	}
+	_, ok := Percentile(agg)
+	return ok
+}
+
+// pNN 类型的百分位数, 比如 p99 返回 99, p99.9 返回 99.9
+func Percentile(agg string) (float64, bool) {
+	if !percentileRegex.MatchString(agg) {
+		return 0, false
+	}
+	q, err := strconv.ParseFloat(agg[1:], 64)
+	if err != nil || q <= 0 || q >= 100 {
+		return 0, false
+	}
+	return q, true
+}
+
+// 检查不同文件上报的序列是否重复, drop_path_tags 时不同文件的关键词可能有相同的 metric 和 tags, 上报后会互相覆盖.
+// 同一个文件中重复的 tag 在合并 include 和检查派生指标时已经报告
+func checkSeries(v *validator, config *Config) {
+	type reported struct {
+		file *WatchFile
+		at   origin
+	}
+	series := make(map[string]reported)
+	add := func(w *WatchFile, metric string, tags string, at origin) {
+		key := metric + "/" + tags
+		r, ok := series[key]
+		if !ok {
+			series[key] = reported{file: w, at: at}
+			return
+		}
+		if r.file == w {
+			return
+		}
+		where := r.at.path
+		if r.at.source != at.source {
+			where = r.at.source + ": " + where
+		}
+		v.errorf(at, "tag", "metric %q with tags %q is also reported by %s, set different metric or tags", metric, tags, where)
+	}
+	for _, w := range config.WatchFiles {
+		if w == nil {
+			continue
+		}
+		for _, keyword := range w.Keywords {
+			for _, agg := range keyword.Aggs {
+				add(w, keyword.Metric, keyword.SeriesTags(*w, agg), keyword.origin)
 			}
 		}
+		for _, d := range w.Derived {
+			add(w, w.Metric, w.SeriesTags(d.Tag, w.StaticTags), d.origin)
+		}
+	}
+}
 
-		// 设置正则表达式
-		for j, keyword := range v.Keywords {
+// 解析派生指标的表达式, 表达式中只能使用同一个文件中关键词的tag
+func checkDerived(v *validator, file *WatchFile, at origin) {
+	tags := make(map[string]bool)
+	timers := make(map[string]int)
+	for _, keyword := range file.Keywords {
+		for _, agg := range keyword.Aggs {
+			tags[keyword.SeriesName(agg)] = true
+			timers[keyword.SeriesName(agg)] = keyword.Timer
+		}
+	}
 
-			if config.WatchFiles[i].Keywords[j].Regex, err = regexp.Compile(keyword.Exp); err != nil {
-				return err
+	for i := range file.Derived {
+		derived := &file.Derived[i]
+		if derived.origin.path == "" {
+			derived.origin = origin{source: at.source, path: fmt.Sprintf("%s.derived[%d]", at.path, i)}
+		}
+		dat := derived.origin
+		if derived.Tag == "" {
+			v.errorf(dat, "tag", "is required")
+		} else if tags[derived.Tag] {
+			v.errorf(dat, "tag", "conflicts with keyword's tag %s", derived.Tag)
+		}
+		if derived.Expression == "" {
+			v.errorf(dat, "expr", "is required")
+			continue
+		}
+
+		var err error
+		if derived.Expr, err = ParseExpr(derived.Expression); err != nil {
+			v.errorf(dat, "expr", "%v", err)
+			continue
+		}
+		for _, tag := range derived.Expr.Tags() {
+			if !tags[tag] {
+				v.errorf(dat, "expr", "unknown tag %s", tag)
+			} else if timers[tag] != file.Timer {
+				// 派生指标和文件的周期相同, 只能使用周期相同的关键词
+				v.errorf(dat, "expr", "tag %s has different timer", tag)
 			}
+		}
+	}
+}
 
-			log.Println("INFO: tag:", keyword.Tag, "regex", config.WatchFiles[i].Keywords[j].Regex.String())
+// 检查告警规则并解析条件
+func checkAlert(v *validator, config *Config, at origin) {
+	if config.Alert.Webhook == "" {
+		v.errorf(at, "alert.webhook", "is required")
+	}
+	if config.Alert.Renotify == 0 {
+		config.Alert.Renotify = 3600
+	}
+
+	for i := range config.Alert.Rules {
+		rule := &config.Alert.Rules[i]
+		path := fmt.Sprintf("alert.rules[%d]", i)
+		if rule.Tag == "" {
+			v.errorf(at, path+".tag", "is required")
+		} else {
+			found := false
+			for _, w := range config.WatchFiles {
+				if w == nil || (rule.Path != "" && rule.Path != w.Path) {
+					continue
+				}
+				for _, keyword := range w.Keywords {
+					for _, agg := range keyword.Aggs {
+						if keyword.SeriesName(agg) == rule.Tag {
+							found = true
+						}
+					}
+				}
+				for _, derived := range w.Derived {
+					if derived.Tag == rule.Tag {
+						found = true
+					}
+				}
+			}
+			if !found {
+				v.errorf(at, path+".tag", "tag %s not found in keywords", rule.Tag)
+			}
+		}
 
-			config.WatchFiles[i].Keywords[j].FixedExp = string(fixExpRegex.ReplaceAll([]byte(keyword.Exp), []byte(".")))
+		if rule.Condition == "" {
+			v.errorf(at, path+".condition", "is required")
+		} else if err := parseCondition(rule); err != nil {
+			v.errorf(at, path+".condition", "%s", strings.TrimPrefix(err.Error(), "ERROR: "))
+		}
+		if rule.Name == "" {
+			rule.Name = rule.Tag + " " + rule.Condition
+		}
+		if rule.Renotify == 0 {
+			rule.Renotify = config.Alert.Renotify
 		}
 	}
+}
 
-	return nil
+func parseCondition(rule *AlertRule) error {
+	condition := strings.TrimSpace(rule.Condition)
+	var err error
+	if m := thresholdRegex.FindStringSubmatch(condition); m != nil {
+		rule.Kind = "threshold"
+		rule.Op = m[1]
+		rule.Threshold, err = strconv.ParseFloat(m[2], 64)
+	} else if m := rateRegex.FindStringSubmatch(condition); m != nil {
+		rule.Kind = "rate"
+		rule.Op = m[1]
+		rule.Threshold, err = strconv.ParseFloat(m[2], 64)
+	} else if m := absentRegex.FindStringSubmatch(condition); m != nil {
+		rule.Kind = "absent"
+		rule.Windows, err = strconv.Atoi(m[1])
+		if err == nil && rule.Windows <= 0 {
+			err = errors.New("ERROR: absent windows must be positive")
+		}
+	} else {
+		err = errors.New("ERROR: unknown alert condition: " + rule.Condition)
+	}
+	return err
 }
 
 func SetLogFile(c *Config) error {
 	for i, v := range c.WatchFiles {
-		if v.PathIsFile {
+		if v.IsPending() {
+			continue
+		}
+		if v.IsFile() {
 			c.WatchFiles[i].ResultFile.FileName = v.Path
 			continue
 		}
@@ -0,0 +1,59 @@
+package config
+
+import "testing"
+
+func TestParseCondition(t *testing.T) {
+	tests := []struct {
+		condition string
+		kind      string
+		op        string
+		threshold float64
+		windows   int
+	}{
+		{"> 10", "threshold", ">", 10, 0},
+		{">=10", "threshold", ">=", 10, 0},
+		{"< -1.5", "threshold", "<", -1.5, 0},
+		{"<= 0", "threshold", "<=", 0, 0},
+		{"== 3", "threshold", "==", 3, 0},
+		{"!= 3", "threshold", "!=", 3, 0},
+		{"  > 10  ", "threshold", ">", 10, 0},
+		{"rate > 2x", "rate", ">", 2, 0},
+		{"rate > 2x last window", "rate", ">", 2, 0},
+		{"rate<0.5x last window", "rate", "<", 0.5, 0},
+		{"absent for 3 windows", "absent", "", 0, 3},
+		{"absent for 1 window", "absent", "", 0, 1},
+	}
+	for _, tt := range tests {
+		rule := AlertRule{Condition: tt.condition}
+		if err := parseCondition(&rule); err != nil {
+			t.Errorf("parseCondition(%q) error: %v", tt.condition, err)
+			continue
+		}
+		if rule.Kind != tt.kind || rule.Op != tt.op || rule.Threshold != tt.threshold || rule.Windows != tt.windows {
+			t.Errorf("parseCondition(%q) = %s %q %v %d, want %s %q %v %d", tt.condition,
+				rule.Kind, rule.Op, rule.Threshold, rule.Windows, tt.kind, tt.op, tt.threshold, tt.windows)
+		}
+	}
+}
+
+func TestParseConditionError(t *testing.T) {
+	tests := []string{
+		"",
+		"10",
+		"> ten",
+		"=> 10",
+		"> 1.2.3",
+		"rate > 2",
+		"rate == 2x",
+		"rate > -2x",
+		"absent for 0 windows",
+		"absent for windows",
+		"absent 3 windows",
+	}
+	for _, condition := range tests {
+		rule := AlertRule{Condition: condition}
+		if err := parseCondition(&rule); err == nil {
+			t.Errorf("parseCondition(%q) want error, got %s %q %v %d", condition, rule.Kind, rule.Op, rule.Threshold, rule.Windows)
+		}
+	}
+}
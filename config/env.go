@@ -0,0 +1,78 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// ${VAR} 或者 ${VAR:-default}, $${ 表示 ${ 本身
+var envRegex = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// 展开 json 格式的配置中所有字符串值里的环境变量, 对象的 key 不展开.
+// 没有设置并且没有默认值的环境变量会报错, unset 不为 nil 时不报错, 保留原样并记录到 unset 中
+func expandEnv(data []byte, unset map[string]bool) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	v, err := expandValue(v, unset)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func expandValue(v interface{}, unset map[string]bool) (interface{}, error) {
+	var err error
+	switch t := v.(type) {
+	case string:
+		return expandString(t, unset)
+	case map[string]interface{}:
+		for k, item := range t {
+			if t[k], err = expandValue(item, unset); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, item := range t {
+			if t[i], err = expandValue(item, unset); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+// HOSTNAME 没有设置时使用系统的主机名
+func expandString(s string, unset map[string]bool) (string, error) {
+	var err error
+	result := envRegex.ReplaceAllStringFunc(s, func(m string) string {
+		if m == "$${" {
+			return "${"
+		}
+		match := envRegex.FindStringSubmatch(m)
+		if value, ok := os.LookupEnv(match[1]); ok && value != "" {
+			return value
+		}
+		if match[2] != "" {
+			return match[3]
+		}
+		if match[1] == "HOSTNAME" {
+			if host, e := os.Hostname(); e == nil {
+				return host
+			}
+		}
+		if unset != nil {
+			unset[match[1]] = true
+		} else if err == nil {
+			err = fmt.Errorf("environment variable %s is not set in %q", match[1], s)
+		}
+		return m
+	})
+	return result, err
+}
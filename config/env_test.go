@@ -0,0 +1,97 @@
+package config
+
+import (
+	"os"
+	"testing"
+)
+
+func TestExpandString(t *testing.T) {
+	os.Setenv("LOGDOG_TEST_SET", "value")
+	os.Setenv("LOGDOG_TEST_EMPTY", "")
+	os.Unsetenv("LOGDOG_TEST_UNSET")
+	defer os.Unsetenv("LOGDOG_TEST_SET")
+	defer os.Unsetenv("LOGDOG_TEST_EMPTY")
+
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"plain", "plain"},
+		{"${LOGDOG_TEST_SET}", "value"},
+		{"a-${LOGDOG_TEST_SET}-b", "a-value-b"},
+		{"${LOGDOG_TEST_SET}${LOGDOG_TEST_SET}", "valuevalue"},
+		{"${LOGDOG_TEST_SET:-default}", "value"},
+		{"${LOGDOG_TEST_UNSET:-default}", "default"},
+		{"${LOGDOG_TEST_UNSET:-}", ""},
+		{"${LOGDOG_TEST_UNSET:-a b/c}", "a b/c"},
+		{"${LOGDOG_TEST_EMPTY:-default}", "default"},
+		{"$${LOGDOG_TEST_SET}", "${LOGDOG_TEST_SET}"},
+		{"$${LOGDOG_TEST_UNSET}", "${LOGDOG_TEST_UNSET}"},
+		{"$$${LOGDOG_TEST_SET}", "$${LOGDOG_TEST_SET}"},
+		{"$LOGDOG_TEST_SET", "$LOGDOG_TEST_SET"},
+		{"${1INVALID}", "${1INVALID}"},
+		{"$", "$"},
+	}
+	for _, tt := range tests {
+		out, err := expandString(tt.in, nil)
+		if err != nil || out != tt.out {
+			t.Errorf("expandString(%q) = %q, %v, want %q", tt.in, out, err, tt.out)
+		}
+	}
+}
+
+func TestExpandStringUnset(t *testing.T) {
+	os.Unsetenv("LOGDOG_TEST_UNSET")
+	os.Setenv("LOGDOG_TEST_EMPTY", "")
+	defer os.Unsetenv("LOGDOG_TEST_EMPTY")
+
+	tests := []struct {
+		in   string
+		name string
+	}{
+		{"${LOGDOG_TEST_UNSET}", "LOGDOG_TEST_UNSET"},
+		{"a-${LOGDOG_TEST_UNSET}", "LOGDOG_TEST_UNSET"},
+		{"${LOGDOG_TEST_EMPTY}", "LOGDOG_TEST_EMPTY"},
+	}
+	for _, tt := range tests {
+		if _, err := expandString(tt.in, nil); err == nil {
+			t.Errorf("expandString(%q) want error", tt.in)
+		}
+
+		// validate 和 convert 不需要运行时的环境变量, 保留原样并记录
+		unset := make(map[string]bool)
+		out, err := expandString(tt.in, unset)
+		if err != nil || out != tt.in || !unset[tt.name] {
+			t.Errorf("expandString(%q, unset) = %q, %v, %v, want %q and %s recorded", tt.in, out, err, unset, tt.in, tt.name)
+		}
+	}
+}
+
+func TestExpandStringHostname(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+	old, ok := os.LookupEnv("HOSTNAME")
+	os.Unsetenv("HOSTNAME")
+	if ok {
+		defer os.Setenv("HOSTNAME", old)
+	}
+
+	if out, err := expandString("${HOSTNAME}", nil); err != nil || out != host {
+		t.Errorf("expandString(${HOSTNAME}) = %q, %v, want %q", out, err, host)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("LOGDOG_TEST_SET", "value")
+	defer os.Unsetenv("LOGDOG_TEST_SET")
+
+	// 只展开字符串值, key 和数字不变
+	in := `{"${LOGDOG_TEST_SET}":"${LOGDOG_TEST_SET}","n":1.50,"list":["$${x}",{"k":"${LOGDOG_TEST_UNSET:-d}"}]}`
+	want := `{"${LOGDOG_TEST_SET}":"value","list":["${x}",{"k":"d"}],"n":1.50}`
+	out, err := expandEnv([]byte(in), nil)
+	if err != nil || string(out) != want {
+		t.Errorf("expandEnv() = %s, %v, want %s", out, err, want)
+	}
+}
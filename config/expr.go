@@ -0,0 +1,208 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/go-errors/errors"
+)
+
+// 除数为0时 Eval 返回的错误
+var ErrDivideByZero = errors.New("divide by zero")
+
+// 派生指标的四则运算表达式, 变量为同一个文件中关键词的tag
+type Expr interface {
+	Eval(values map[string]float64) (float64, error)
+	Tags() []string
+}
+
+type numberExpr float64
+
+type tagExpr string
+
+type binaryExpr struct {
+	op          byte
+	left, right Expr
+}
+
+type negExpr struct {
+	x Expr
+}
+
+func (e numberExpr) Eval(values map[string]float64) (float64, error) {
+	return float64(e), nil
+}
+
+func (e numberExpr) Tags() []string {
+	return nil
+}
+
+func (e tagExpr) Eval(values map[string]float64) (float64, error) {
+	return values[string(e)], nil
+}
+
+func (e tagExpr) Tags() []string {
+	return []string{string(e)}
+}
+
+func (e *binaryExpr) Eval(values map[string]float64) (float64, error) {
+	l, err := e.left.Eval(values)
+	if err != nil {
+		return 0, err
+	}
+	r, err := e.right.Eval(values)
+	if err != nil {
+		return 0, err
+	}
+	switch e.op {
+	case '+':
+		return l + r, nil
+	case '-':
+		return l - r, nil
+	case '*':
+		return l * r, nil
+	default:
+		if r == 0 {
+			return 0, ErrDivideByZero
+		}
+		return l / r, nil
+	}
+}
+
+func (e *binaryExpr) Tags() []string {
+	return append(e.left.Tags(), e.right.Tags()...)
+}
+
+func (e *negExpr) Eval(values map[string]float64) (float64, error) {
+	x, err := e.x.Eval(values)
+	return -x, err
+}
+
+func (e *negExpr) Tags() []string {
+	return e.x.Tags()
+}
+
+// 解析表达式, 支持 + - * / 括号 数字 和tag
+func ParseExpr(s string) (Expr, error) {
+	p := &exprParser{s: s}
+	e, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected %q at %d in %q", p.s[p.pos], p.pos, s)
+	}
+	return e, nil
+}
+
+type exprParser struct {
+	s   string
+	pos int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *exprParser) parseSum() (Expr, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.s) || (p.s[p.pos] != '+' && p.s[p.pos] != '-') {
+			return left, nil
+		}
+		op := p.s[p.pos]
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseProduct() (Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.s) || (p.s[p.pos] != '*' && p.s[p.pos] != '/') {
+			return left, nil
+		}
+		op := p.s[p.pos]
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (Expr, error) {
+	p.skipSpace()
+	if p.pos < len(p.s) && p.s[p.pos] == '-' {
+		p.pos++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &negExpr{x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (Expr, error) {
+	p.skipSpace()
+	if p.pos >= len(p.s) {
+		return nil, fmt.Errorf("unexpected end of %q", p.s)
+	}
+
+	c := p.s[p.pos]
+	switch {
+	case c == '(':
+		p.pos++
+		e, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.pos >= len(p.s) || p.s[p.pos] != ')' {
+			return nil, fmt.Errorf("missing ) in %q", p.s)
+		}
+		p.pos++
+		return e, nil
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.s) && (p.s[p.pos] >= '0' && p.s[p.pos] <= '9' || p.s[p.pos] == '.') {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, err
+		}
+		return numberExpr(v), nil
+	case isTagChar(c, true):
+		start := p.pos
+		for p.pos < len(p.s) && isTagChar(p.s[p.pos], false) {
+			p.pos++
+		}
+		return tagExpr(p.s[start:p.pos]), nil
+	}
+	return nil, fmt.Errorf("unexpected %q at %d in %q", c, p.pos, p.s)
+}
+
+func isTagChar(c byte, first bool) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' {
+		return true
+	}
+	return !first && (c >= '0' && c <= '9' || c == '.')
+}
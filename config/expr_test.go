@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseExpr(t *testing.T) {
+	values := map[string]float64{"error": 5, "total": 20, "req.count": 4, "zero": 0}
+	tests := []struct {
+		expr  string
+		value float64
+		tags  []string
+	}{
+		{"1 + 2 * 3", 7, nil},
+		{"(1 + 2) * 3", 9, nil},
+		{"10 - 4 - 3", 3, nil},
+		{"24 / 4 / 2", 3, nil},
+		{"2 * 3 - 8 / 4", 4, nil},
+		{"-2 * 3", -6, nil},
+		{"--2", 2, nil},
+		{"3 - -2", 5, nil},
+		{"-(1 + 2)", -3, nil},
+		{"error / total * 100", 25, []string{"error", "total"}},
+		{"total - error * 2", 10, []string{"total", "error"}},
+		{"req.count * 0.5", 2, []string{"req.count"}},
+		{"  error+total ", 25, []string{"error", "total"}},
+	}
+	for _, tt := range tests {
+		e, err := ParseExpr(tt.expr)
+		if err != nil {
+			t.Errorf("ParseExpr(%q) error: %v", tt.expr, err)
+			continue
+		}
+		value, err := e.Eval(values)
+		if err != nil || value != tt.value {
+			t.Errorf("ParseExpr(%q).Eval() = %v, %v, want %v", tt.expr, value, err, tt.value)
+		}
+		if tags := e.Tags(); fmt.Sprint(tags) != fmt.Sprint(tt.tags) {
+			t.Errorf("ParseExpr(%q).Tags() = %v, want %v", tt.expr, tags, tt.tags)
+		}
+	}
+}
+
+func TestParseExprError(t *testing.T) {
+	tests := []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 + 2)",
+		"error total",
+		"2 * * 3",
+		"1..2",
+		"9abc",
+		"a % b",
+	}
+	for _, expr := range tests {
+		if _, err := ParseExpr(expr); err == nil {
+			t.Errorf("ParseExpr(%q) want error", expr)
+		}
+	}
+}
+
+func TestEvalDivideByZero(t *testing.T) {
+	values := map[string]float64{"error": 5, "zero": 0}
+	tests := []string{
+		"error / zero",
+		"error / (zero * 2)",
+		"1 + error / 0",
+		"-(error / zero)",
+	}
+	for _, expr := range tests {
+		e, err := ParseExpr(expr)
+		if err != nil {
+			t.Errorf("ParseExpr(%q) error: %v", expr, err)
+			continue
+		}
+		if _, err = e.Eval(values); err != ErrDivideByZero {
+			t.Errorf("ParseExpr(%q).Eval() error = %v, want %v", expr, err, ErrDivideByZero)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// 支持的配置文件格式
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// 根据扩展名判断配置文件的格式, .yaml .yml 为 yaml, .toml 为 toml, 其它为 json
+func FileFormat(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	}
+	return FormatJSON
+}
+
+// 把 format 格式的配置转换为 json, 配置结构只有 json tag, 其它格式都先转换为 json 再解析
+func ToJSON(data []byte, format string) ([]byte, error) {
+	var v interface{}
+	switch format {
+	case FormatJSON:
+		return data, nil
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+	case FormatTOML:
+		m := make(map[string]interface{})
+		if err := toml.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		v = m
+	default:
+		return nil, fmt.Errorf("unknown config format %s", format)
+	}
+	return json.Marshal(v)
+}
+
+// 把 json 格式的配置转换为 format 格式, 用于转换已有的配置文件
+func FromJSON(data []byte, format string) ([]byte, error) {
+	if format == FormatJSON {
+		return data, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	v = plainValue(v)
+
+	switch format {
+	case FormatYAML:
+		return yaml.Marshal(v)
+	case FormatTOML:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("config must be an object")
+		}
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(m); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown config format %s", format)
+}
+
+// 整数保持为整数(比如 timer 不会变成 30.0), 去掉 toml 不支持的 null
+func plainValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		for k, item := range t {
+			if item == nil {
+				delete(t, k)
+				continue
+			}
+			t[k] = plainValue(item)
+		}
+	case []interface{}:
+		for i, item := range t {
+			t[i] = plainValue(item)
+		}
+	}
+	return v
+}
+
+// 解析 format 格式的配置, 字符串中的环境变量会被展开
+func DecodeConfig(data []byte, format string) (*Config, error) {
+	return decodeConfig(data, format, true, nil)
+}
+
+// 解析 format 格式的配置, 不展开环境变量, 用于检查配置模板的格式, 比如转换格式时
+func DecodeTemplate(data []byte, format string) (*Config, error) {
+	return decodeConfig(data, format, false, nil)
+}
+
+func decodeConfig(data []byte, format string, expand bool, unset map[string]bool) (*Config, error) {
+	var config *Config
+	bytes, err := ToJSON(data, format)
+	if err == nil && expand {
+		bytes, err = expandEnv(bytes, unset)
+	}
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(bytes, &config); err != nil {
+		return config, err
+	}
+	if config == nil {
+		return config, fmt.Errorf("config is empty")
+	}
+	return config, nil
+}
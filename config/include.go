@@ -0,0 +1,170 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+)
+
+// include 目录中的配置片段, 只能配置监控文件
+type fragment struct {
+	WatchFiles []*WatchFile `json:"files"`
+}
+
+// 合并后的监控文件, 记录每个序列来自哪个配置文件, 用于报告冲突
+type mergedFile struct {
+	file   *WatchFile
+	source string
+	series map[string]string
+}
+
+// include 目录的实际路径, 相对路径相对于配置文件所在的目录
+func includeDir(configFile string, include string) string {
+	if include == "" || filepath.IsAbs(include) {
+		return include
+	}
+	return filepath.Join(filepath.Dir(configFile), include)
+}
+
+// 判断文件是不是 include 目录中的配置片段, 隐藏文件和其它扩展名的文件(比如编辑器的临时文件)会被忽略
+func IsFragment(file string) bool {
+	base := filepath.Base(file)
+	if base == "" || base[0] == '.' {
+		return false
+	}
+	switch filepath.Ext(base) {
+	case ".json", ".yaml", ".yml", ".toml":
+		return true
+	}
+	return false
+}
+
+// 按文件名顺序读取 include 目录中的配置片段, 把监控文件合并到配置中.
+// path 和 filepattern 相同的监控文件合并为一个, 关键词和派生指标的序列名不能重复
+func includeFiles(config *Config, configFile string, unset map[string]bool) error {
+	merged := make([]*mergedFile, 0, len(config.WatchFiles))
+	index := make(map[string]*mergedFile)
+	files := config.WatchFiles
+	config.WatchFiles = nil
+	config.source = configFile
+	if err := mergeFiles(&merged, index, files, configFile); err != nil {
+		return err
+	}
+
+	config.IncludeDir = includeDir(configFile, config.Include)
+	if config.IncludeDir != "" {
+		infos, err := ioutil.ReadDir(config.IncludeDir)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(infos))
+		for _, info := range infos {
+			// include 目录和配置文件在同一个目录时跳过配置文件本身
+			if !info.IsDir() && IsFragment(info.Name()) && filepath.Join(config.IncludeDir, info.Name()) != filepath.Clean(configFile) {
+				names = append(names, info.Name())
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			file := filepath.Join(config.IncludeDir, name)
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			var f fragment
+			if err = decodeFragment(data, FileFormat(file), &f, unset); err != nil {
+				return fmt.Errorf("%s: %v", file, err)
+			}
+			if err = mergeFiles(&merged, index, f.WatchFiles, file); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, m := range merged {
+		config.WatchFiles = append(config.WatchFiles, m.file)
+	}
+	return nil
+}
+
+// 合并 include 目录中的监控文件, 用于检查通过 /push_config 推送的配置
+func IncludeFiles(config *Config, configFile string) error {
+	return includeFiles(config, configFile, nil)
+}
+
+func decodeFragment(data []byte, format string, f *fragment, unset map[string]bool) error {
+	bytes, err := ToJSON(data, format)
+	if err == nil {
+		bytes, err = expandEnv(bytes, unset)
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, f)
+}
+
+func mergeFiles(merged *[]*mergedFile, index map[string]*mergedFile, files []*WatchFile, source string) error {
+	for i, v := range files {
+		if v == nil {
+			return fmt.Errorf("%s: files[%d] can not be null", source, i)
+		}
+		// 记录在原来的配置文件中的位置, 合并后检查配置时报告问题的位置
+		v.origin = origin{source: source, path: fmt.Sprintf("files[%d]", i)}
+		for j := range v.Keywords {
+			v.Keywords[j].origin = origin{source: source, path: fmt.Sprintf("files[%d].keywords[%d]", i, j)}
+		}
+		for j := range v.Derived {
+			v.Derived[j].origin = origin{source: source, path: fmt.Sprintf("files[%d].derived[%d]", i, j)}
+		}
+		key := v.Path + v.FilePattern
+		m, ok := index[key]
+		if !ok {
+			m = &mergedFile{file: v, source: source, series: make(map[string]string)}
+			index[key] = m
+			*merged = append(*merged, m)
+		} else {
+			// 文件级别的配置只能在一个地方设置, 或者设置相同的值, 没有设置时使用其它地方设置的值
+			if (v.Metric != "" && m.file.Metric != "" && v.Metric != m.file.Metric) ||
+				(v.Timer != 0 && m.file.Timer != 0 && v.Timer != m.file.Timer) ||
+				(len(v.Tags) > 0 && len(m.file.Tags) > 0 && !reflect.DeepEqual(v.Tags, m.file.Tags)) {
+				return fmt.Errorf("%s: file %s %s has different metric, timer or tags from %s", source, v.Path, v.FilePattern, m.source)
+			}
+			if m.file.Metric == "" {
+				m.file.Metric = v.Metric
+			}
+			if m.file.Timer == 0 {
+				m.file.Timer = v.Timer
+			}
+			if len(m.file.Tags) == 0 {
+				m.file.Tags = v.Tags
+			}
+			m.file.DropPathTags = m.file.DropPathTags || v.DropPathTags
+			m.file.Keywords = append(m.file.Keywords, v.Keywords...)
+			m.file.Derived = append(m.file.Derived, v.Derived...)
+		}
+
+		names := make([]string, 0, len(v.Keywords)+len(v.Derived))
+		for _, keyword := range v.Keywords {
+			if len(keyword.Types) == 0 {
+				names = append(names, keyword.Tag)
+			}
+			for _, agg := range keyword.Types {
+				names = append(names, keyword.Tag+"."+agg)
+			}
+		}
+		for _, d := range v.Derived {
+			names = append(names, d.Tag)
+		}
+		for _, name := range names {
+			if s, ok := m.series[name]; ok {
+				return fmt.Errorf("%s: tag %s of file %s %s is already defined in %s", source, name, v.Path, v.FilePattern, s)
+			}
+			m.series[name] = source
+		}
+	}
+	return nil
+}
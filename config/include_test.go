@@ -0,0 +1,204 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeFiles(t *testing.T) {
+	keyword := func(tag string, types ...string) KeyWord {
+		return KeyWord{Exp: tag, Tag: tag, Types: types}
+	}
+	tests := []struct {
+		name   string
+		first  *WatchFile
+		second *WatchFile
+		err    string
+		want   *WatchFile
+	}{
+		{
+			name:   "different path",
+			first:  &WatchFile{Path: "/a", Keywords: []KeyWord{keyword("x")}},
+			second: &WatchFile{Path: "/b", Keywords: []KeyWord{keyword("x")}},
+		},
+		{
+			name:   "different filepattern",
+			first:  &WatchFile{Path: "/a", FilePattern: "a", Keywords: []KeyWord{keyword("x")}},
+			second: &WatchFile{Path: "/a", FilePattern: "b", Keywords: []KeyWord{keyword("x")}},
+		},
+		{
+			name:   "adopt unset settings",
+			first:  &WatchFile{Path: "/a", Keywords: []KeyWord{keyword("x")}},
+			second: &WatchFile{Path: "/a", Metric: "m", Timer: 60, Tags: map[string]string{"k": "v"}, DropPathTags: true, Keywords: []KeyWord{keyword("y")}},
+			want:   &WatchFile{Path: "/a", Metric: "m", Timer: 60, Tags: map[string]string{"k": "v"}, DropPathTags: true, Keywords: []KeyWord{keyword("x"), keyword("y")}},
+		},
+		{
+			name:   "keep settings",
+			first:  &WatchFile{Path: "/a", Metric: "m", Timer: 60, Tags: map[string]string{"k": "v"}, DropPathTags: true, Keywords: []KeyWord{keyword("x")}},
+			second: &WatchFile{Path: "/a", Keywords: []KeyWord{keyword("y")}},
+			want:   &WatchFile{Path: "/a", Metric: "m", Timer: 60, Tags: map[string]string{"k": "v"}, DropPathTags: true, Keywords: []KeyWord{keyword("x"), keyword("y")}},
+		},
+		{
+			name:   "same settings",
+			first:  &WatchFile{Path: "/a", Metric: "m", Timer: 60, Tags: map[string]string{"k": "v"}, Keywords: []KeyWord{keyword("x")}},
+			second: &WatchFile{Path: "/a", Metric: "m", Timer: 60, Tags: map[string]string{"k": "v"}, Keywords: []KeyWord{keyword("y")}},
+			want:   &WatchFile{Path: "/a", Metric: "m", Timer: 60, Tags: map[string]string{"k": "v"}, Keywords: []KeyWord{keyword("x"), keyword("y")}},
+		},
+		{
+			name:   "different metric",
+			first:  &WatchFile{Path: "/a", Metric: "m1", Keywords: []KeyWord{keyword("x")}},
+			second: &WatchFile{Path: "/a", Metric: "m2", Keywords: []KeyWord{keyword("y")}},
+			err:    "different metric, timer or tags",
+		},
+		{
+			name:   "different timer",
+			first:  &WatchFile{Path: "/a", Timer: 30, Keywords: []KeyWord{keyword("x")}},
+			second: &WatchFile{Path: "/a", Timer: 60, Keywords: []KeyWord{keyword("y")}},
+			err:    "different metric, timer or tags",
+		},
+		{
+			name:   "different tags",
+			first:  &WatchFile{Path: "/a", Tags: map[string]string{"k": "v1"}, Keywords: []KeyWord{keyword("x")}},
+			second: &WatchFile{Path: "/a", Tags: map[string]string{"k": "v2"}, Keywords: []KeyWord{keyword("y")}},
+			err:    "different metric, timer or tags",
+		},
+		{
+			name:   "duplicate tag",
+			first:  &WatchFile{Path: "/a", Keywords: []KeyWord{keyword("x")}},
+			second: &WatchFile{Path: "/a", Keywords: []KeyWord{keyword("x")}},
+			err:    "tag x of file /a  is already defined in first.json",
+		},
+		{
+			name:   "duplicate tag with types",
+			first:  &WatchFile{Path: "/a", Keywords: []KeyWord{keyword("x", "avg", "max")}},
+			second: &WatchFile{Path: "/a", Keywords: []KeyWord{keyword("x.max")}},
+			err:    "tag x.max of file /a  is already defined in first.json",
+		},
+		{
+			name:   "types with different names",
+			first:  &WatchFile{Path: "/a", Keywords: []KeyWord{keyword("x", "avg")}},
+			second: &WatchFile{Path: "/a", Keywords: []KeyWord{keyword("x")}},
+			want:   &WatchFile{Path: "/a", Keywords: []KeyWord{keyword("x", "avg"), keyword("x")}},
+		},
+		{
+			name:   "derived tag conflicts with keyword",
+			first:  &WatchFile{Path: "/a", Keywords: []KeyWord{keyword("x")}},
+			second: &WatchFile{Path: "/a", Keywords: []KeyWord{keyword("y")}, Derived: []Derived{{Tag: "x", Expression: "y"}}},
+			err:    "tag x of file /a  is already defined in first.json",
+		},
+		{
+			name:   "null file",
+			first:  &WatchFile{Path: "/a", Keywords: []KeyWord{keyword("x")}},
+			second: nil,
+			err:    "null",
+		},
+	}
+
+	for _, tt := range tests {
+		merged := make([]*mergedFile, 0)
+		index := make(map[string]*mergedFile)
+		err := mergeFiles(&merged, index, []*WatchFile{tt.first}, "first.json")
+		if err == nil {
+			err = mergeFiles(&merged, index, []*WatchFile{tt.second}, "second.json")
+		}
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error = %v", tt.name, err)
+			continue
+		}
+		if tt.want == nil {
+			if len(merged) != 2 {
+				t.Errorf("%s: got %d files, want 2", tt.name, len(merged))
+			}
+			continue
+		}
+		if len(merged) != 1 {
+			t.Errorf("%s: got %d files, want 1", tt.name, len(merged))
+			continue
+		}
+		got := merged[0].file
+		if got.Metric != tt.want.Metric || got.Timer != tt.want.Timer || got.DropPathTags != tt.want.DropPathTags || !reflect.DeepEqual(got.Tags, tt.want.Tags) {
+			t.Errorf("%s: got metric %q timer %d tags %v drop %v, want metric %q timer %d tags %v drop %v", tt.name,
+				got.Metric, got.Timer, got.Tags, got.DropPathTags, tt.want.Metric, tt.want.Timer, tt.want.Tags, tt.want.DropPathTags)
+		}
+		tags := make([]string, 0, len(got.Keywords))
+		wantTags := make([]string, 0, len(tt.want.Keywords))
+		for _, k := range got.Keywords {
+			tags = append(tags, k.Tag)
+		}
+		for _, k := range tt.want.Keywords {
+			wantTags = append(wantTags, k.Tag)
+		}
+		if !reflect.DeepEqual(tags, wantTags) {
+			t.Errorf("%s: got keywords %v, want %v", tt.name, tags, wantTags)
+		}
+	}
+}
+
+func TestIncludeFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logdog-include")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"cfg.json":  `{"files":[{"path":"/a","keywords":[{"exp":"x","tag":"x"}]}]}`,
+		"b.yaml":    "files:\n  - path: /a\n    metric: m\n    keywords:\n      - exp: z\n        tag: z\n",
+		"a.json":    `{"files":[{"path":"/a","keywords":[{"exp":"y","tag":"y"}]},{"path":"/b","keywords":[{"exp":"x","tag":"x"}]}]}`,
+		"c.toml":    "[[files]]\npath = \"/c\"\n[[files.keywords]]\nexp = \"x\"\ntag = \"x\"\n",
+		".hidden":   `{"files":[{"path":"/hidden"}]}`,
+		"d.json~":   `{"files":[{"path":"/backup"}]}`,
+		"notes.txt": "not a fragment",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// include 目录和配置文件在同一个目录, 配置文件本身不会被当作配置片段
+	configFile := filepath.Join(dir, "cfg.json")
+	c := &Config{Include: ".", WatchFiles: []*WatchFile{{Path: "/a", Keywords: []KeyWord{{Exp: "x", Tag: "x"}}}}}
+	if err := IncludeFiles(c, configFile); err != nil {
+		t.Fatal(err)
+	}
+	if c.IncludeDir != dir {
+		t.Errorf("IncludeDir = %q, want %q", c.IncludeDir, dir)
+	}
+
+	want := map[string][]string{"/a": {"x", "y", "z"}, "/b": {"x"}, "/c": {"x"}}
+	got := make(map[string][]string)
+	order := make([]string, 0)
+	for _, f := range c.WatchFiles {
+		order = append(order, f.Path)
+		for _, k := range f.Keywords {
+			got[f.Path] = append(got[f.Path], k.Tag)
+		}
+	}
+	if !reflect.DeepEqual(got, want) || !reflect.DeepEqual(order, []string{"/a", "/b", "/c"}) {
+		t.Errorf("merged files %v %v, want %v", order, got, want)
+	}
+	if c.WatchFiles[0].Metric != "m" {
+		t.Errorf("metric of /a = %q, want m", c.WatchFiles[0].Metric)
+	}
+
+	// 合并冲突时报告冲突的两个配置文件
+	if err := ioutil.WriteFile(filepath.Join(dir, "e.json"), []byte(`{"files":[{"path":"/b","keywords":[{"exp":"x","tag":"x"}]}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c = &Config{Include: "."}
+	err = IncludeFiles(c, configFile)
+	if err == nil || !strings.Contains(err.Error(), filepath.Join(dir, "e.json")) || !strings.Contains(err.Error(), filepath.Join(dir, "a.json")) {
+		t.Errorf("IncludeFiles() error = %v, want conflict between a.json and e.json", err)
+	}
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+// 校验配置时发现的问题, Path 是问题所在的位置, 比如 files[2].keywords[1].exp
+type Problem struct {
+	Source  string
+	Path    string
+	Message string
+	Warning bool
+}
+
+func (p Problem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+	return level + ": " + p.location()
+}
+
+// 不带级别的问题, 用于 CheckConfig 返回的错误
+func (p Problem) location() string {
+	s := p.Message
+	if p.Path != "" {
+		s = p.Path + ": " + s
+	}
+	if p.Source != "" {
+		s = p.Source + ": " + s
+	}
+	return s
+}
+
+// 配置项所在的配置文件和位置
+type origin struct {
+	source string
+	path   string
+}
+
+type validator struct {
+	problems []Problem
+}
+
+// field 是相对于 at 的位置, 为空时就是 at 本身
+func (v *validator) add(at origin, field string, warning bool, format string, args []interface{}) {
+	path := at.path
+	if path == "" {
+		path = field
+	} else if field != "" {
+		path += "." + field
+	}
+	v.problems = append(v.problems, Problem{Source: at.source, Path: path, Message: fmt.Sprintf(format, args...), Warning: warning})
+}
+
+func (v *validator) errorf(at origin, field string, format string, args ...interface{}) {
+	v.add(at, field, false, format, args)
+}
+
+func (v *validator) warnf(at origin, field string, format string, args ...interface{}) {
+	v.add(at, field, true, format, args)
+}
+
+// 需要 exp 中第一个分组的数字的统计方式
+func needsGroup(agg string) bool {
+	switch agg {
+	case "count", "rate", "distinct", "topk":
+		return false
+	}
+	return true
+}
+
+// 按照启动时的流程读取和检查配置文件, 和 CheckConfig 不同, 会报告所有的问题和可能有问题的配置
+func ValidateConfig(configFile string) []Problem {
+	// 没有设置的环境变量只给出警告, CI 中可能没有运行时的环境变量
+	unset := make(map[string]bool)
+	// 读取和合并配置时的错误已经带有所在的文件
+	c, err := readConfig(configFile, unset)
+	if err != nil {
+		return []Problem{{Message: err.Error()}}
+	}
+
+	problems := checkConfig(c)
+	names := make([]string, 0, len(unset))
+	for name := range unset {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		problems = append(problems, Problem{Source: configFile, Message: fmt.Sprintf("environment variable %s is not set, ${%s} is kept as is", name, name), Warning: true})
+	}
+	return problems
+}
@@ -2,29 +2,45 @@ package config_server
 
 import (
 	"net/http"
-	"encoding/json"
 	"fmt"
+	"mime"
 	"io/ioutil"
 	"os"
 	"../config"
 	"log"
 )
 
-func Push_handler() {
+func Push_handler(listen string) {
 	http.HandleFunc("/push_config", func(w http.ResponseWriter, req *http.Request) {
 		fmt.Println(req.Method)
 		if req.Method == "POST" {
 			result, _:= ioutil.ReadAll(req.Body)
 			req.Body.Close()
 			fmt.Printf("%s\n", result)
-			var cfg *config.Config
-
-			json.Unmarshal(result, &cfg)
-			if err := json.Unmarshal(result, &cfg); err != nil {
+			// 根据 Content-Type 判断格式, 没有指定时和配置文件的格式相同
+			fileFormat := config.FileFormat(config.ConfigFile)
+			format := contentFormat(req.Header.Get("Content-Type"), fileFormat)
+			cfg, err := config.DecodeConfig(result, format)
+			if err != nil {
 				fmt.Println(err)
 				http.Error(w, "connot decode body", http.StatusBadRequest)
 				return
 			}
+			// 保存时转换为配置文件的格式
+			if format != fileFormat {
+				if result, err = convertConfig(result, format, fileFormat); err != nil {
+					fmt.Println(err)
+					http.Error(w, "connot convert body to "+fileFormat, http.StatusBadRequest)
+					return
+				}
+			}
+
+			// 和读取配置文件时一样合并 include 目录, 关键词可能在配置片段中
+			if err := config.IncludeFiles(cfg, config.ConfigFile); err != nil {
+				log.Println(err)
+				http.Error(w, "include error: "+err.Error(), http.StatusBadRequest)
+				return
+			}
 
 			if err := config.CheckConfig(cfg); err != nil {
 				log.Println(err)
@@ -32,7 +48,7 @@ func Push_handler() {
 				return
 			} else {
 				fmt.Println(cfg.LogLevel)
-				file, err := os.OpenFile("cfg.json", os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
+				file, err := os.OpenFile(config.ConfigFile, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
 				defer file.Close()
 				if err != nil {
 					http.Error(w, "open file error", http.StatusBadRequest)
@@ -48,7 +64,7 @@ func Push_handler() {
 			}
 
 		} else {
-			w.Write([]byte("Only support POST json"))
+			w.Write([]byte("Only support POST json, yaml or toml"))
 		}
 
 	})
@@ -61,9 +77,29 @@ func Push_handler() {
 		}
 	})
 
-	fmt.Println("Listen at 0.0.0.0:8008")
-	http.ListenAndServe("0.0.0.0:8008", nil)
+	fmt.Println("Listen at", listen)
+	if err := http.ListenAndServe(listen, nil); err != nil {
+		log.Fatalln(err)
+	}
 }
 
+func contentFormat(contentType string, fallback string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/json":
+		return config.FormatJSON
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return config.FormatYAML
+	case "application/toml", "text/toml":
+		return config.FormatTOML
+	}
+	return fallback
+}
 
-
+func convertConfig(data []byte, from string, to string) ([]byte, error) {
+	bytes, err := config.ToJSON(data, from)
+	if err != nil {
+		return nil, err
+	}
+	return config.FromJSON(bytes, to)
+}
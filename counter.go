@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"./config"
+	"./log"
+)
+
+// COUNTER 类型关键词的累计值, key 和 keywords 相同
+var (
+	counterTotals = make(map[string]float64)
+	counterLock   sync.Mutex
+)
+
+// 把本周期的值累加到总数上, 返回新的总数
+func addCounter(key string, value float64) float64 {
+	counterLock.Lock()
+	defer counterLock.Unlock()
+	counterTotals[key] += value
+	return counterTotals[key]
+}
+
+// 启动时读取上次保存的累计值, 重启后继续单调递增
+func loadCounters(c *config.Config) {
+	bytes, err := ioutil.ReadFile(c.StateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("read counter state", c.StateFile, err)
+		}
+		return
+	}
+
+	counterLock.Lock()
+	defer counterLock.Unlock()
+	if err = json.Unmarshal(bytes, &counterTotals); err != nil {
+		log.Error("decode counter state", c.StateFile, err)
+		counterTotals = make(map[string]float64)
+		return
+	}
+	log.Info("load counter state from", c.StateFile, len(counterTotals), "counters")
+}
+
+// 保存累计值, 先写临时文件再改名, 避免写到一半时退出导致文件损坏
+func saveCounters(c *config.Config) {
+	counterLock.Lock()
+	if len(counterTotals) == 0 {
+		counterLock.Unlock()
+		return
+	}
+	bytes, err := json.Marshal(counterTotals)
+	counterLock.Unlock()
+	if err != nil {
+		log.Error("marshal counter state", err)
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(c.StateFile), 0755); err != nil {
+		log.Error("create counter state dir", c.StateFile, err)
+		return
+	}
+	tmp := c.StateFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, bytes, 0644); err != nil {
+		log.Error("write counter state", tmp, err)
+		return
+	}
+	if err = os.Rename(tmp, c.StateFile); err != nil {
+		log.Error("rename counter state", tmp, err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"./config"
+	"./log"
+)
+
+// 计算周期在 end 时刻结束的文件的派生指标, values 的 key 和 keywords 相同, 计算结果也会加入 values
+func derivedData(c *config.Config, values map[string]float64, end int64) []config.PushData {
+	data := make([]config.PushData, 0)
+	for _, v := range c.WatchFiles {
+		if len(v.Derived) == 0 || end%int64(v.Timer) != 0 {
+			continue
+		}
+
+		tagValues := make(map[string]float64)
+		for _, p := range v.Keywords {
+			for _, agg := range p.Aggs {
+				name := p.SeriesName(agg)
+				tagValues[name] = values[v.Path+v.FilePattern+name]
+			}
+		}
+
+		for _, d := range v.Derived {
+			value, err := d.Expr.Eval(tagValues)
+			if err == config.ErrDivideByZero {
+				if d.DivZero == nil {
+					log.Debug("derived", d.Tag, "divide by zero, skip:", d.Expression)
+					continue
+				}
+				value = *d.DivZero
+			} else if err != nil {
+				log.Error("derived", d.Tag, err)
+				continue
+			}
+
+			values[v.Path+v.FilePattern+d.Tag] = value
+			data = append(data, config.PushData{Metric: v.Metric,
+				Endpoint:    c.Host,
+				Timestamp:   end - int64(v.Timer),
+				Value:       value,
+				Step:        v.Timer,
+				CounterType: "GAUGE",
+				Tags:        v.SeriesTags(d.Tag, v.StaticTags),
+			})
+		}
+	}
+	return data
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sync"
+)
+
+// HyperLogLog 的精度, 2^14 个寄存器, 标准误差约 0.8%
+const hllPrecision = 14
+
+// distinct 类型关键词本周期的去重集合, 数量不超过阈值时精确计数, 超过后转为 HyperLogLog
+type distinctSet struct {
+	exact map[string]struct{}
+	hll   *hyperLogLog
+}
+
+var (
+	distinctSets = make(map[string]*distinctSet)
+	distinctLock sync.Mutex
+)
+
+// 加入一个值
+func addDistinct(key string, value string, threshold int) {
+	distinctLock.Lock()
+	defer distinctLock.Unlock()
+
+	set, ok := distinctSets[key]
+	if !ok {
+		set = &distinctSet{exact: make(map[string]struct{})}
+		distinctSets[key] = set
+	}
+
+	if set.hll != nil {
+		set.hll.add(value)
+		return
+	}
+
+	set.exact[value] = struct{}{}
+	if len(set.exact) > threshold {
+		set.hll = newHyperLogLog()
+		for v := range set.exact {
+			set.hll.add(v)
+		}
+		set.exact = nil
+	}
+}
+
+// 上报时取出去重后的数量并清空, 下个周期重新计数
+func popDistinct(key string) float64 {
+	distinctLock.Lock()
+	defer distinctLock.Unlock()
+
+	set, ok := distinctSets[key]
+	if !ok {
+		return 0
+	}
+	delete(distinctSets, key)
+	if set.hll != nil {
+		return set.hll.count()
+	}
+	return float64(len(set.exact))
+}
+
+type hyperLogLog struct {
+	registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]uint8, 1<<hllPrecision)}
+}
+
+func (h *hyperLogLog) add(value string) {
+	hash := hash64(value)
+	idx := hash >> (64 - hllPrecision)
+	rho := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rho > h.registers[idx] {
+		h.registers[idx] = rho
+	}
+}
+
+func (h *hyperLogLog) count() float64 {
+	m := float64(len(h.registers))
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += 1.0 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// 数量较少时使用线性计数修正
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return math.Floor(estimate + 0.5)
+}
+
+// fnv 的结果再做一次 murmur3 的 finalizer, 让各个位分布更均匀
+func hash64(value string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(value))
+	h := f.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestDistinct(t *testing.T) {
+	tests := []struct {
+		name      string
+		values    int
+		repeat    int
+		threshold int
+		tolerance float64 // 相对误差
+	}{
+		{"empty", 0, 1, 100, 0},
+		{"exact", 100, 1, 100, 0},
+		{"exact with repeats", 100, 5, 100, 0},
+		{"just over threshold", 101, 1, 100, 0.03},
+		{"sketch", 10000, 1, 100, 0.03},
+		{"sketch with repeats", 10000, 3, 1000, 0.03},
+		{"large sketch", 200000, 1, 10000, 0.03},
+	}
+	for _, tt := range tests {
+		key := "test" + tt.name
+		for r := 0; r < tt.repeat; r++ {
+			for i := 0; i < tt.values; i++ {
+				addDistinct(key, "value-"+strconv.Itoa(i), tt.threshold)
+			}
+		}
+		got := popDistinct(key)
+		if diff := math.Abs(got-float64(tt.values)) / math.Max(float64(tt.values), 1); diff > tt.tolerance {
+			t.Errorf("%s: distinct = %v, want %d (error %.4f > %.4f)", tt.name, got, tt.values, diff, tt.tolerance)
+		}
+		// 上报后清空, 下个周期重新计数
+		if got := popDistinct(key); got != 0 {
+			t.Errorf("%s: distinct after pop = %v, want 0", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"net/http"
+	"sync"
+	"time"
+
+	"./config"
+	"./log"
+)
+
+// 匹配到关键词的日志行
+type capturedLine struct {
+	Timestamp int64  `json:"timestamp"`
+	Endpoint  string `json:"endpoint"`
+	Tags      string `json:"tags"`
+	Line      string `json:"line"`
+}
+
+// 每个关键词每秒输出的行数
+type lineLimiter struct {
+	second int64
+	count  int
+}
+
+var (
+	lineQueue    = make(chan capturedLine, 1000)
+	lineLimiters = make(map[string]*lineLimiter)
+	limiterLock  sync.Mutex
+	lineClient   = &http.Client{Timeout: 10 * time.Second} //webhook 没有响应时不能一直阻塞输出
+)
+
+// 按照关键词的 capture 配置限速和截断后放入输出队列, 队列满时丢弃
+func captureLine(file config.WatchFile, p config.KeyWord, line string) {
+	capture := p.Capture
+	if capture == nil {
+		return
+	}
+
+	key := file.Path + file.FilePattern + p.Tag
+	now := time.Now().Unix()
+	limiterLock.Lock()
+	limiter, ok := lineLimiters[key]
+	if !ok {
+		limiter = &lineLimiter{}
+		lineLimiters[key] = limiter
+	}
+	if limiter.second != now {
+		limiter.second = now
+		limiter.count = 0
+	}
+	limiter.count++
+	allowed := limiter.count <= capture.Rate
+	limiterLock.Unlock()
+	if !allowed {
+		return
+	}
+
+	line = truncateLine(line, capture.MaxLength)
+
+	l := capturedLine{
+		Timestamp: now,
+		Endpoint:  config.Cfg.Host,
+		Tags:      file.SeriesTags(p.Tag, p.StaticTags),
+		Line:      line,
+	}
+	select {
+	case lineQueue <- l:
+	default:
+		log.Warn("line queue is full, drop line:", l.Tags)
+	}
+}
+
+type lineSender interface {
+	send(l capturedLine) error
+	close()
+}
+
+// 从队列中取出日志行发送到 line_sink, 配置变化时重新创建
+func lineForwarder() {
+	var sender lineSender
+	var senderCfg config.LineSink
+
+	for l := range lineQueue {
+		c := config.Cfg.LineSink
+		if c == nil {
+			continue
+		}
+
+		if sender == nil || *c != senderCfg {
+			if sender != nil {
+				sender.close()
+				sender = nil
+			}
+			s, err := newLineSender(c)
+			if err != nil {
+				log.Error("create line sink", c.Type, err)
+				continue
+			}
+			sender = s
+			senderCfg = *c
+		}
+
+		if err := sender.send(l); err != nil {
+			log.Error("send line to", c.Type, err)
+		}
+	}
+}
+
+func newLineSender(c *config.LineSink) (lineSender, error) {
+	switch c.Type {
+	case "file":
+		return &fileLineSender{cfg: config.FileSink{Path: c.Path, MaxSize: c.MaxSize, MaxBackups: c.MaxBackups}}, nil
+	case "webhook":
+		return &webhookLineSender{url: c.Url}, nil
+	case "syslog":
+		w, err := syslog.Dial(c.Network, c.Address, syslog.LOG_WARNING|syslog.LOG_DAEMON, "falcon-logdog")
+		if err != nil {
+			return nil, err
+		}
+		return &syslogLineSender{writer: w}, nil
+	}
+	return nil, fmt.Errorf("unknown line sink type %s", c.Type)
+}
+
+// 每行一个json对象追加到文件
+type fileLineSender struct {
+	cfg  config.FileSink
+	sink fileSink
+}
+
+func (s *fileLineSender) send(l capturedLine) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return s.sink.write(&s.cfg, append(b, '\n'))
+}
+
+func (s *fileLineSender) close() {
+	if s.sink.file != nil {
+		s.sink.file.Close()
+	}
+}
+
+// 每行以json对象 POST 到 url
+type webhookLineSender struct {
+	url string
+}
+
+func (s *webhookLineSender) send(l capturedLine) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	resp, err := lineClient.Post(s.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("webhook status %d, body: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+func (s *webhookLineSender) close() {}
+
+type syslogLineSender struct {
+	writer *syslog.Writer
+}
+
+func (s *syslogLineSender) send(l capturedLine) error {
+	return s.writer.Warning(l.Tags + " " + l.Line)
+}
+
+func (s *syslogLineSender) close() {
+	s.writer.Close()
+}
@@ -103,3 +103,9 @@ func Debugf(format string, args ...interface{}) {
 func Close() {
 	logger.Close()
 }
+
+// 重新设置输出的最低级别, 比如子命令只需要输出错误
+func SetLevel(level log4go.Level) {
+	logger.Close()
+	logger = log4go.NewConsoleLogger(level)
+}
@@ -1,16 +1,19 @@
 package main
 
 import (
-	"io/ioutil"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
-	"strings"
 	"time"
-	"encoding/json"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/hpcloud/tail"
@@ -22,87 +25,121 @@ import (
 )
 
 var (
-	workers  chan bool
-	keywords cmap.ConcurrentMap
+	workers      chan bool
+	keywords     cmap.ConcurrentMap
+	processStart = time.Now()
+	windowStarts = make(map[string]time.Time) //每个 rate 序列上次上报的时间, timer 变化时也能按实际时长计算
+	windowLock   sync.Mutex
+	errNoGroup   = errors.New("no group in exp")
+	reloaded     = make(chan bool, 1) //配置热更新后通知 scheduler 按照新的 timer 重新计算下次醒来的时刻
 )
 
+// 等待中的路径没有收到目录变化的事件时, 定时检查是否出现
+const pendingCheckInterval = 10 * time.Second
+
+const VERSION = "0.2.0"
+
 func main() {
+	cfg := flag.String("c", config.ConfigFile, "configuration file")
+	listen := flag.String("listen", "0.0.0.0:8008", "http listen address")
+	stateDir := flag.String("state-dir", config.StateDir, "directory of state files")
+	version := flag.Bool("v", false, "show version")
+	flag.Parse()
+
+	if *version {
+		fmt.Println(VERSION)
+		return
+	}
+	config.ConfigFile = *cfg
+	config.StateDir = *stateDir
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
 	if err := config.Init_config(); err != nil {
 		return
 	}
 	workers = make(chan bool, runtime.NumCPU()*2)
 	keywords = cmap.New()
+	loadCounters(config.Cfg)
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	go func() {
-		for {
-			old_tick := config.Cfg.Timer
-			ticker := time.NewTicker(time.Second * time.Duration(int64(config.Cfg.Timer)))
-			for range ticker.C {
-				if config.Cfg.Timer != old_tick {
-					old_tick = config.Cfg.Timer
-					break
-				}
-				fillData()
-				postData()
-			}
-		}
-	}()
+	go scheduler()
 	go func() {
 		for i := 0; i < len(config.Cfg.WatchFiles); i++ {
-			readFileAndSetTail(&(config.Cfg.WatchFiles[i]))
-			go logFileWatcher(&(config.Cfg.WatchFiles[i]))
+			startWatchFile(config.Cfg.WatchFiles[i])
 		}
 	}()
 	go func() {
 		ConfigFileWatcher()
 	}()
-	config_server.Push_handler()
+	go lineForwarder()
+	http.HandleFunc("/push_stats", pushStatsHandler)
+	http.HandleFunc("/keywords/", samplesHandler)
+	http.HandleFunc("/status", statusHandler)
+	config_server.Push_handler(*listen)
+}
+
+// 上报调度, 每个周期在 timer 的整数倍时刻(比如 :00 :30)结束, 不同机器的数据可以对齐
+// 文件和关键词可以有不同的 timer, 每次醒来时上报周期在这个时刻结束的数据
+// 配置热更新后立即按照新的 timer 重新计算, timer 变小时不会错过新周期的上报
+func scheduler() {
+	for {
+		now := time.Now()
+		next := int64(0)
+		for _, step := range config.Cfg.Timers() {
+			end := (now.Unix()/int64(step) + 1) * int64(step)
+			if next == 0 || end < next {
+				next = end
+			}
+		}
+		wait := time.NewTimer(time.Unix(next, 0).Sub(now))
+		select {
+		case <-reloaded:
+			wait.Stop()
+			continue
+		case <-wait.C:
+		}
+
+		fillData(next)
+		postData(next)
+	}
 }
 
 //配置文件监控,可以实现热更新
+//include 目录中的配置片段新增, 修改或者删除时也会重新加载
 func ConfigFileWatcher() {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer watcher.Close()
+	includeDir := config.Cfg.IncludeDir
 	done := make(chan bool)
 	go func() {
 		for {
 			select {
 			case event := <-watcher.Events:
-				if event.Name == config.ConfigFile && event.Op == fsnotify.Write {
+				configChanged := filepath.Clean(event.Name) == filepath.Clean(config.ConfigFile) && event.Op == fsnotify.Write
+				fragmentChanged := includeDir != "" && filepath.Dir(event.Name) == filepath.Clean(includeDir) &&
+					config.IsFragment(event.Name) && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0
+				if configChanged || fragmentChanged {
 					log.Debug("event : modified config file", event.Name, "will reaload config", event.Op)
 					old_cfg := config.Cfg
+					// 新的配置有错误时输出所有的错误, 继续使用旧的配置
 					if new_config, err := config.ReadConfig(config.ConfigFile); err != nil {
-						log.Debug("ERROR: event: config has error, will not use old config", err)
-					} else if config.CheckConfig(new_config) != nil {
-						log.Debug("ERROR: event: config has error, will not use old config", err)
-					} else if config.SetLogFile(new_config) != nil {
-						log.Debug("ERROR: event: config has error, will not use old config", err)
+						log.Error("event: config has error, will use old config:", err)
+					} else if err = config.CheckConfig(new_config); err != nil {
+						log.Error("event: config has error, will use old config:", err)
+					} else if err = config.SetLogFile(new_config); err != nil {
+						log.Error("event: config has error, will use old config:", err)
 					} else {
-						log.Debug("event: config reload success", )
+						log.Debug("event: config reload success")
 						log.Debug("event: new config:", new_config)
-						log.Debug("event: old watcher all killed success")
-						for _, v := range old_cfg.WatchFiles {
-							if v.ResultFile.LogTail != nil {
-								log.Debug("event: try to stop old tail")
-								v.Close_chan <- true
-								v.ResultFile.LogTail.Stop()
-							}
-						}
-						log.Debug("event: stop all old tail -f ")
-
-						log.Debug("use new config")
-						config.Cfg = new_config
-						for i := 0; i < len(config.Cfg.WatchFiles); i++ {
-							log.Debug("event: try to start new tail")
-							readFileAndSetTail(&(config.Cfg.WatchFiles[i]))
-							go logFileWatcher(&(config.Cfg.WatchFiles[i]))
-
+						applyConfig(old_cfg, new_config)
+						if new_config.IncludeDir != includeDir {
+							watchIncludeDir(watcher, includeDir, new_config.IncludeDir)
+							includeDir = new_config.IncludeDir
 						}
-						log.Debug("event: satrt new file tail success")
-
 					}
 
 				}
@@ -112,13 +149,228 @@ func ConfigFileWatcher() {
 		}
 	}()
 
-	err = watcher.Add(".")
+	// 监控配置文件所在的目录
+	err = watcher.Add(filepath.Dir(config.ConfigFile))
 	if err != nil {
 		log.Fatal(err)
 	}
+	watchIncludeDir(watcher, "", includeDir)
 	<-done
 }
 
+// include 目录变化时更换监控的目录
+func watchIncludeDir(watcher *fsnotify.Watcher, old string, dir string) {
+	if old != "" && filepath.Clean(old) != filepath.Dir(filepath.Clean(config.ConfigFile)) {
+		watcher.Remove(old)
+	}
+	if dir != "" {
+		if err := watcher.Add(dir); err != nil {
+			log.Error("watch include dir", dir, err)
+		}
+	}
+}
+
+// 使用新的配置, 只重启 path 或 filepattern 变化了的文件,
+// 没有变化的文件保留正在运行的 tail 和已经统计的值, 只更新关键词等配置
+func applyConfig(old_cfg *config.Config, new_config *config.Config) {
+	oldFiles := make(map[string]*config.WatchFile)
+	for _, v := range old_cfg.WatchFiles {
+		oldFiles[v.Path+"\x00"+v.FilePattern] = v
+	}
+
+	started := make([]*config.WatchFile, 0)
+	for _, v := range new_config.WatchFiles {
+		id := v.Path + "\x00" + v.FilePattern
+		old, ok := oldFiles[id]
+		if !ok || old.IsFile() != v.IsFile() {
+			log.Info("event: config reload: add file", v.Path, v.FilePattern)
+			started = append(started, v)
+			continue
+		}
+		delete(oldFiles, id)
+		// 先切换到新的配置, 之后 tail 不会再用旧的定义写入下面丢弃的序列
+		v.TakeOver(old)
+
+		// 关键词有变化时丢弃已经统计的值
+		for _, name := range changedSeries(old, v) {
+			log.Info("event: config reload: keyword changed", v.Path, v.FilePattern, name)
+			dropSeries(v.Path + v.FilePattern + name)
+		}
+		// timer 有变化时保留已经统计的值, 在新周期结束时上报
+		for _, p := range v.Keywords {
+			for _, agg := range p.Aggs {
+				key := v.Path + v.FilePattern + p.SeriesName(agg)
+				if d, ok := keywords.Get(key); ok && d.(config.PushData).Step != p.Timer {
+					data := d.(config.PushData)
+					data.Step = p.Timer
+					keywords.Set(key, data)
+				}
+			}
+		}
+	}
+
+	for _, v := range oldFiles {
+		log.Info("event: config reload: remove file", v.Path, v.FilePattern)
+		stopWatchFile(v)
+		for _, name := range seriesNames(v) {
+			dropSeries(v.Path + v.FilePattern + name)
+		}
+	}
+
+	config.Cfg = new_config
+	select {
+	case reloaded <- true:
+	default:
+	}
+	for _, v := range started {
+		startWatchFile(v)
+	}
+	log.Infof("event: config reload: %d files kept, %d added, %d removed",
+		len(new_config.WatchFiles)-len(started), len(started), len(oldFiles))
+}
+
+// 开始 tail 和目录监控, path 还不存在时等待它出现
+func startWatchFile(file *config.WatchFile) {
+	if file.IsPending() {
+		go waitForPath(file)
+		return
+	}
+	readFileAndSetTail(file)
+	go logFileWatcher(file)
+}
+
+// 监控 path 最近的存在的上级目录, 上级目录中有变化或者定时检查 path 是否出现, 出现后开始监控
+func waitForPath(file *config.WatchFile) {
+	log.Info("event: wait for path --- ", file.Path)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer watcher.Close()
+	ticker := time.NewTicker(pendingCheckInterval)
+	defer ticker.Stop()
+
+	parent := ""
+	for {
+		if _, err := os.Stat(file.Path); err == nil {
+			break
+		}
+		// 上级目录可能是逐层创建的, 每次都重新查找最近的存在的目录
+		if dir := existingParent(file.Path); dir != parent {
+			if parent != "" {
+				watcher.Remove(parent)
+			}
+			if err := watcher.Add(dir); err != nil {
+				log.Error("watch dir", dir, err)
+			}
+			parent = dir
+			continue
+		}
+		select {
+		case <-file.Close_chan:
+			log.Debug("event: wait for path stoped --- ", file.Path)
+			return
+		case <-watcher.Events:
+		case err := <-watcher.Errors:
+			log.Error(err)
+		case <-ticker.C:
+		}
+	}
+	watcher.Close()
+
+	if err := file.Activate(); err != nil {
+		log.Error("activate watch file", file.Path, err)
+	}
+	log.Info("event: path created, start to watch --- ", file.Path)
+	// 文件是在等待期间创建的, 从头开始读取, 不丢失创建后写入的内容
+	tailFile(file, os.SEEK_SET)
+	logFileWatcher(file)
+}
+
+func existingParent(p string) string {
+	dir := filepath.Dir(filepath.Clean(p))
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// 停止文件的 tail 和目录监控
+func stopWatchFile(file *config.WatchFile) {
+	file.Close_chan <- true
+	if file.ResultFile.LogTail != nil {
+		file.ResultFile.LogTail.Stop()
+	}
+}
+
+// 文件中所有关键词和派生指标的名称
+func seriesNames(file *config.WatchFile) []string {
+	names := make([]string, 0)
+	for _, p := range file.Keywords {
+		for _, agg := range p.Aggs {
+			names = append(names, p.SeriesName(agg))
+		}
+	}
+	for _, d := range file.Derived {
+		names = append(names, d.Tag)
+	}
+	return names
+}
+
+// 新旧配置中删除了或者定义有变化的序列, exp 统计方式 metric tags 等任何一项变化时,
+// 已经统计的值不能再使用
+func changedSeries(old *config.WatchFile, new_file *config.WatchFile) []string {
+	definitions := make(map[string]string)
+	for _, p := range new_file.Keywords {
+		for _, agg := range p.Aggs {
+			definitions[p.SeriesName(agg)] = seriesDefinition(new_file, p, agg)
+		}
+	}
+
+	changed := make([]string, 0)
+	for _, p := range old.Keywords {
+		for _, agg := range p.Aggs {
+			if d, ok := definitions[p.SeriesName(agg)]; !ok || d != seriesDefinition(old, p, agg) {
+				changed = append(changed, p.SeriesName(agg))
+			}
+		}
+	}
+	return changed
+}
+
+// 决定序列统计结果的配置, timer 不在其中, timer 变化时保留已经统计的值
+func seriesDefinition(file *config.WatchFile, p config.KeyWord, agg string) string {
+	return strings.Join([]string{p.Exp, agg, p.Metric, p.CounterType, p.SeriesTags(*file, agg),
+		strconv.Itoa(p.DistinctThreshold), strconv.Itoa(p.TopK), strconv.Itoa(p.TopKCapacity)}, "\x00")
+}
+
+// 删除序列已经统计的值和 distinct topk pNN rate 保存在其它地方的状态
+func dropSeries(key string) {
+	keywords.Remove(key)
+
+	distinctLock.Lock()
+	delete(distinctSets, key)
+	distinctLock.Unlock()
+
+	topkLock.Lock()
+	delete(topkSketches, key)
+	topkLock.Unlock()
+
+	percentileLock.Lock()
+	delete(percentileReservoirs, key)
+	percentileLock.Unlock()
+
+	windowLock.Lock()
+	delete(windowStarts, key)
+	windowLock.Unlock()
+}
+
 func logFileWatcher(file *config.WatchFile) {
 	logTail := file.ResultFile.LogTail
 	watcher, err := fsnotify.NewWatcher()
@@ -135,9 +387,10 @@ func logFileWatcher(file *config.WatchFile) {
 			select {
 			case <- file.Close_chan:
 				log.Debug("event: log file watcher stoped --- ", file.ResultFile.FileName)
-				break
+				close(done)
+				return
 			case event := <-watcher.Events:
-				if file.PathIsFile && event.Op == fsnotify.Create && event.Name == file.Path {
+				if file.IsFile() && event.Op == fsnotify.Create && event.Name == file.Path {
 					log.Info("continue to watch file:", event.Name)
 					if file.ResultFile.LogTail != nil {
 						logTail.Stop()
@@ -168,7 +421,7 @@ func logFileWatcher(file *config.WatchFile) {
 	}()
 
 	watchPath := file.Path
-	if file.PathIsFile {
+	if file.IsFile() {
 		watchPath = filepath.Dir(file.Path)
 	}
 	err = watcher.Add(watchPath)
@@ -180,6 +433,11 @@ func logFileWatcher(file *config.WatchFile) {
 }
 
 func readFileAndSetTail(file *config.WatchFile) {
+	tailFile(file, os.SEEK_END)
+}
+
+// whence 是开始读取的位置, os.SEEK_SET 从头开始, os.SEEK_END 只读取新写入的内容
+func tailFile(file *config.WatchFile, whence int) {
 	if file.ResultFile.FileName == "" {
 		return
 	}
@@ -190,7 +448,7 @@ func readFileAndSetTail(file *config.WatchFile) {
 	}
 
 	log.Info("event:  read file", file.ResultFile.FileName, file)
-	tail_end, err := tail.TailFile(file.ResultFile.FileName, tail.Config{Follow: true, Location: &tail.SeekInfo{Offset: 0, Whence: os.SEEK_END}})
+	tail_end, err := tail.TailFile(file.ResultFile.FileName, tail.Config{Follow: true, Location: &tail.SeekInfo{Offset: 0, Whence: whence}})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -199,7 +457,8 @@ func readFileAndSetTail(file *config.WatchFile) {
 	log.Debug("event: will start tail", file.ResultFile.FileName)
 	go func() {
 		for line := range tail_end.Lines {
-			handleKeywords(*file, line.Text)
+			// 热更新时关键词会整体替换, 每行读取一次当前的配置
+			handleKeywords(*file.Current(), line.Text)
 		}
 	}()
 
@@ -208,211 +467,234 @@ func readFileAndSetTail(file *config.WatchFile) {
 // 查找关键词
 func handleKeywords(file config.WatchFile, line string) {
 	for _, p := range file.Keywords {
-		switch p.Type {
-		case "count":
-			value := 0.0
-			if p.Regex.MatchString(line) {
-				value = 1.0
-			}
-			key := file.Path + file.FilePattern + p.Tag
+		// 每个关键词只匹配一次, 再按照每种统计方式更新
+		new_value_array := p.Regex.FindStringSubmatch(line)
+		if new_value_array == nil {
+			continue
+		}
+		matchedLine(file, p, line)
+
+		// 第一个分组的数字, 除了 count rate distinct topk 以外的统计方式都需要
+		new_value_float, err := 0.0, errNoGroup
+		if len(new_value_array) > 1 {
+			new_value_float, err = strconv.ParseFloat(new_value_array[1], 64)
+		}
+
+		for _, agg := range p.Aggs {
+			key := file.Path + file.FilePattern + p.SeriesName(agg)
 			var data config.PushData
 			if v, ok := keywords.Get(key); ok {
-				d := v.(config.PushData)
-				d.Value += value
-				data = d
+				data = v.(config.PushData)
 			} else {
-				data = config.PushData{Metric: config.Cfg.Metric,
+				data = config.PushData{Metric: p.Metric,
 					Endpoint:    config.Cfg.Host,
 					Timestamp:   time.Now().Unix(),
-					Value:       value,
-					Step:        config.Cfg.Timer,
-					CounterType: "GAUGE",
-					Tags:		"path="+file.Path+",filepattern="+file.FilePattern+",tag="+p.Tag,
+					Step:        p.Timer,
+					CounterType: p.CounterType,
+					Tags:        p.SeriesTags(file, agg),
+					Type:        agg,
 				}
 			}
-			keywords.Set(key, data)
-		case "min":
-			new_value_array :=  p.Regex.FindStringSubmatch(line)
-			if len(new_value_array) > 1 {
-				new_value := new_value_array[1]
-				new_value_float, err := strconv.ParseFloat(new_value, 64)
-				if err != nil {
-					log.Error("")
-					continue
-				}
-				key := file.Path + file.FilePattern + p.Tag
-				var data config.PushData
-				if v, ok := keywords.Get(key); ok {
-					d := v.(config.PushData)
-					if new_value_float < d.Value {
-						d.Value = new_value_float
+
+			switch agg {
+			case "count":
+				data.Value += 1
+			case "rate":
+				// 有分组时累加分组匹配到的数字, 否则累加匹配的行数, 上报时除以实际的周期时长
+				if len(new_value_array) > 1 {
+					if err != nil {
+						log.Error("parse", new_value_array[1], err)
+						continue
 					}
-					data = d
+					data.Value += new_value_float
 				} else {
-					data = config.PushData{Metric: config.Cfg.Metric,
-						Endpoint:    config.Cfg.Host,
-						Timestamp:   time.Now().Unix(),
-						Value:       new_value_float,
-						Step:        config.Cfg.Timer,
-						CounterType: "GAUGE",
-						Tags:		"path="+file.Path+",filepattern="+file.FilePattern+",tag="+p.Tag,
-					}
+					data.Value += 1
 				}
-				keywords.Set(key, data)
-			} else {
-				log.Debug("no match")
-			}
-		case "max":
-			new_value_array :=  p.Regex.FindStringSubmatch(line)
-			if len(new_value_array) > 1 {
-				new_value := new_value_array[1]
-				new_value_float, err := strconv.ParseFloat(new_value, 64)
-				if err != nil {
-					log.Error("")
-					continue
+			case "distinct", "topk":
+				// 有分组时统计第一个分组, 否则统计整个匹配
+				new_value := new_value_array[0]
+				if len(new_value_array) > 1 {
+					new_value = new_value_array[1]
 				}
-				key := file.Path + file.FilePattern + p.Tag
-				var data config.PushData
-				if v, ok := keywords.Get(key); ok {
-					d := v.(config.PushData)
-					if new_value_float > d.Value {
-						d.Value = new_value_float
-					}
-					data = d
+				if agg == "distinct" {
+					// 去重后的数量在上报时计算
+					addDistinct(key, new_value, p.DistinctThreshold)
 				} else {
-					data = config.PushData{Metric: config.Cfg.Metric,
-						Endpoint:    config.Cfg.Host,
-						Timestamp:   time.Now().Unix(),
-						Value:       new_value_float,
-						Step:        config.Cfg.Timer,
-						CounterType: "GAUGE",
-						Tags:		"path="+file.Path+",filepattern="+file.FilePattern+",tag="+p.Tag,
-					}
+					// 这里只记录匹配的总行数, 每个值的计数在上报时展开
+					addTopK(key, new_value, p.TopK, p.TopKCapacity)
+					data.Value += 1
 				}
-				keywords.Set(key, data)
-			} else {
-				log.Debug("no match")
-			}
-		case "avg":
-			new_value_array :=  p.Regex.FindStringSubmatch(line)
-			if len(new_value_array) > 1 {
-				new_value := new_value_array[1]
-				new_value_float, err := strconv.ParseFloat(new_value, 64)
-				if err != nil {
-					log.Error("")
+			default:
+				if err == errNoGroup {
+					log.Debug("no match")
 					continue
-				}
-				key := file.Path + file.FilePattern + p.Tag
-				var data config.PushData
-				if v, ok := keywords.Get(key); ok {
-					d := v.(config.PushData)
-					d.Value = (d.Value*float64(d.Count)+new_value_float)/(1.0+float64(d.Count))
-					d.Count += 1
-					data = d
-				} else {
-					data = config.PushData{Metric: config.Cfg.Metric,
-						Endpoint:    config.Cfg.Host,
-						Timestamp:   time.Now().Unix(),
-						Value:       new_value_float,
-						Step:        config.Cfg.Timer,
-						CounterType: "GAUGE",
-						Tags:		"path="+file.Path+",filepattern="+file.FilePattern+",tag="+p.Tag,
-						Count: 1,
-					}
-				}
-				keywords.Set(key, data)
-			} else {
-				log.Debug("no match")
-			}
-		case "sum":
-			new_value_array :=  p.Regex.FindStringSubmatch(line)
-			if len(new_value_array) > 1 {
-				new_value := new_value_array[1]
-				new_value_float, err := strconv.ParseFloat(new_value, 64)
-				if err != nil {
-					log.Error("")
+				} else if err != nil {
+					log.Error("parse", new_value_array[1], err)
 					continue
 				}
-				key := file.Path + file.FilePattern + p.Tag
-				var data config.PushData
-				if v, ok := keywords.Get(key); ok {
-					d := v.(config.PushData)
-					d.Value += new_value_float
-					data = d
-				} else {
-					data = config.PushData{Metric: config.Cfg.Metric,
-						Endpoint:    config.Cfg.Host,
-						Timestamp:   time.Now().Unix(),
-						Value:       new_value_float,
-						Step:        config.Cfg.Timer,
-						CounterType: "GAUGE",
-						Tags:		"path="+file.Path+",filepattern="+file.FilePattern+",tag="+p.Tag,
-					}
-				}
-				keywords.Set(key, data)
-			} else {
-				log.Debug("no match")
+				updateValue(&data, agg, key, new_value_float)
 			}
+			keywords.Set(key, data)
 		}
 	}
 }
 
-func postData() {
+// 更新需要数字的统计方式, Count 为0时表示还没有匹配过, 可能是 fillData 补全的数据
+func updateValue(data *config.PushData, agg string, key string, value float64) {
+	switch agg {
+	case "sum":
+		data.Value += value
+	case "min":
+		if data.Count == 0 || value < data.Value {
+			data.Value = value
+		}
+	case "max":
+		if data.Count == 0 || value > data.Value {
+			data.Value = value
+		}
+	case "avg":
+		data.Value = (data.Value*float64(data.Count) + value) / (1.0 + float64(data.Count))
+	case "last":
+		data.Value = value
+	case "first":
+		if data.Count == 0 {
+			data.Value = value
+		}
+	case "stddev", "variance":
+		// Welford 算法, 不需要保存所有的值
+		delta := value - data.Mean
+		data.Mean += delta / float64(data.Count+1)
+		data.M2 += delta * (value - data.Mean)
+		data.Value = data.M2 / float64(data.Count+1)
+		if agg == "stddev" {
+			data.Value = math.Sqrt(data.Value)
+		}
+	default:
+		// pNN, 百分位数在上报时计算
+		addPercentile(key, value)
+	}
+	data.Count += 1
+}
+
+// 上报周期在 end 时刻结束的数据, 每条数据的 Step 是它的周期, timestamp 是周期开始的时刻
+func postData(end int64) {
 	c := config.Cfg
-	workers <- true
+	now := time.Now()
 
-	go func() {
-		if len(keywords.Items()) != 0 {
-			data := make([]config.PushData, 0, 3000)
-			for k, v := range keywords.Items() {
-				tem_data := v.(config.PushData)
-				tem_data.Timestamp = time.Now().Unix()
-				data = append(data, tem_data)
-				keywords.Remove(k)
-			}
+	data, values := collectData(end, func(key string, step int) float64 {
+		return now.Sub(swapWindowStart(key, step, end, now)).Seconds()
+	})
+	saveCounters(c)
+	if len(data) == 0 {
+		return
+	}
 
-			bytes, err := json.Marshal(data)
-			if err != nil {
-				log.Error("marshal push data", data, err)
-				return
-			}
+	data = append(data, derivedData(c, values, end)...)
+	evaluateAlerts(c, values)
+	writeFileSink(c, data)
+	if c.Agent == "" {
+		return
+	}
 
-			log.Debug("pushing data:", string(bytes))
+	batches, err := splitBatches(c, data)
+	if err != nil {
+		log.Error("marshal push data", data, err)
+		return
+	}
 
-			resp, err := http.Post(c.Agent, "plain/text", strings.NewReader(string(bytes)))
-			if err != nil {
-				log.Error(" post data ", string(bytes), " to agent ", err)
-			} else {
-				defer resp.Body.Close()
-				bytes, _ = ioutil.ReadAll(resp.Body)
-				log.Debug("push data", string(bytes))
+	deadline := pushDeadline(c, now)
+	for _, batch := range batches {
+		go func(body []byte) {
+			log.Debug("pushing data:", string(body))
+			pushToAgent(c, body, deadline)
+		}(batch)
+	}
+}
+
+// 取出周期在 end 时刻结束的数据并从 keywords 中删除, values 是每个序列本周期的值,
+// elapsed 返回序列本周期实际的时长, 用于计算 rate
+func collectData(end int64, elapsed func(key string, step int) float64) ([]config.PushData, map[string]float64) {
+	data := make([]config.PushData, 0, 3000)
+	values := make(map[string]float64)
+	for k, v := range keywords.Items() {
+		tem_data := v.(config.PushData)
+		if tem_data.Step <= 0 || end%int64(tem_data.Step) != 0 {
+			continue
+		}
+		tem_data.Timestamp = end - int64(tem_data.Step)
+		if tem_data.Type == "rate" {
+			if seconds := elapsed(k, tem_data.Step); seconds > 0 {
+				tem_data.Value = tem_data.Value / seconds
 			}
 		}
+		if tem_data.Type == "distinct" {
+			tem_data.Value = popDistinct(k)
+		}
+		if q, ok := config.Percentile(tem_data.Type); ok {
+			tem_data.Value = popPercentile(k, q)
+		}
+		values[k] = tem_data.Value
+		// COUNTER 上报累计值, 由 open-falcon 计算速率
+		if tem_data.CounterType == "COUNTER" {
+			tem_data.Value = addCounter(k, tem_data.Value)
+		}
+		if tem_data.Type == "topk" {
+			data = append(data, popTopK(k, tem_data)...)
+		} else {
+			data = append(data, tem_data)
+		}
+		keywords.Remove(k)
+	}
+	return data, values
+}
 
-		<-workers
-	}()
-
+// 序列本周期实际开始的时间, 用于计算 rate, 启动后的第一个周期不完整,
+// 并记录下个周期从 now 开始
+func swapWindowStart(key string, step int, end int64, now time.Time) time.Time {
+	windowLock.Lock()
+	defer windowLock.Unlock()
+	start, ok := windowStarts[key]
+	windowStarts[key] = now
+	if ok {
+		return start
+	}
+	start = time.Unix(end-int64(step), 0)
+	if processStart.After(start) {
+		return processStart
+	}
+	return start
 }
 
-func fillData() {
+// 为周期在 end 时刻结束的关键词补全数据
+func fillData(end int64) {
 	c := config.Cfg
 	for _, v := range c.WatchFiles {
 		for _, p := range v.Keywords {
-			key := v.Path + v.FilePattern + p.Tag
-			if _, ok := keywords.Get(key); ok {
+			if end%int64(p.Timer) != 0 {
 				continue
 			}
+			for _, agg := range p.Aggs {
+				// last 和 first 是自己上报的状态值(比如队列长度), 补0是错误的值, 没有匹配的周期不上报
+				if agg == "last" || agg == "first" {
+					continue
+				}
+				key := v.Path + v.FilePattern + p.SeriesName(agg)
+				if _, ok := keywords.Get(key); ok {
+					continue
+				}
 
-			//不存在要插入一个补全
-			data := config.PushData{Metric: c.Metric,
-				Endpoint:    c.Host,
-				Timestamp:   time.Now().Unix(),
-				Value:       0.0,
-				Step:        c.Timer,
-				CounterType: "GAUGE",
-				Tags:		"path="+v.Path+",filepattern="+v.FilePattern+",tag="+p.Tag,
+				//不存在要插入一个补全
+				data := config.PushData{Metric: p.Metric,
+					Endpoint:    c.Host,
+					Timestamp:   time.Now().Unix(),
+					Value:       0.0,
+					Step:        p.Timer,
+					CounterType: p.CounterType,
+					Tags:        p.SeriesTags(*v, agg),
+					Type:        agg,
+				}
+				keywords.Set(key, data)
 			}
-			keywords.Set(key, data)
 		}
 	}
 }
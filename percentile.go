@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// 每个 pNN 序列每个周期最多保留的样本数, 超过后使用水塘抽样
+const percentileSamples = 1024
+
+type percentileReservoir struct {
+	values []float64
+	seen   int64
+}
+
+var (
+	percentileReservoirs = make(map[string]*percentileReservoir)
+	percentileLock       sync.Mutex
+)
+
+func addPercentile(key string, value float64) {
+	percentileLock.Lock()
+	defer percentileLock.Unlock()
+
+	r, ok := percentileReservoirs[key]
+	if !ok {
+		r = &percentileReservoir{values: make([]float64, 0, 16)}
+		percentileReservoirs[key] = r
+	}
+
+	r.seen++
+	if len(r.values) < percentileSamples {
+		r.values = append(r.values, value)
+	} else if i := rand.Int63n(r.seen); i < percentileSamples {
+		r.values[i] = value
+	}
+}
+
+// 上报时计算百分位数并清空, 使用 nearest-rank 方法
+func popPercentile(key string, q float64) float64 {
+	percentileLock.Lock()
+	r, ok := percentileReservoirs[key]
+	delete(percentileReservoirs, key)
+	percentileLock.Unlock()
+	if !ok || len(r.values) == 0 {
+		return 0
+	}
+
+	sort.Float64s(r.values)
+	rank := int(math.Ceil(q / 100 * float64(len(r.values))))
+	if rank < 1 {
+		rank = 1
+	}
+	return r.values[rank-1]
+}
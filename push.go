@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"./config"
+	"./log"
+)
+
+// 推送结果计数
+var pushStats struct {
+	Success    int64 //推送成功
+	Retried    int64 //可重试错误后的重试次数
+	Permanent  int64 //agent拒收,不再重试
+	Exhausted  int64 //重试次数用完仍失败
+	DeadLetter int64 //写入dead letter文件
+	Dropped    int64 //失败且没有配置dead letter文件,直接丢弃
+}
+
+// 单次推送的超时时间
+var pushClient = &http.Client{Timeout: 10 * time.Second}
+
+// 推送失败的错误, retryable 表示是否值得重试
+type pushError struct {
+	retryable bool
+	msg       string
+}
+
+func (e *pushError) Error() string {
+	return e.msg
+}
+
+// 把数据按 batch_size 和 batch_bytes 切分成多个json数组
+// 单条数据超过 batch_bytes 时单独成为一批
+func splitBatches(c *config.Config, data []config.PushData) ([][]byte, error) {
+	batches := make([][]byte, 0, 1)
+	var buf bytes.Buffer
+	count := 0
+	for _, d := range data {
+		item, err := json.Marshal(d)
+		if err != nil {
+			return nil, err
+		}
+		// 加上 "[", "]" 和 "," 的长度
+		if count > 0 && (count >= c.BatchSize || buf.Len()+len(item)+2 > c.BatchBytes) {
+			buf.WriteByte(']')
+			batches = append(batches, append([]byte(nil), buf.Bytes()...))
+			buf.Reset()
+			count = 0
+		}
+		if count == 0 {
+			buf.WriteByte('[')
+		} else {
+			buf.WriteByte(',')
+		}
+		buf.Write(item)
+		count++
+	}
+	if count > 0 {
+		buf.WriteByte(']')
+		batches = append(batches, buf.Bytes())
+	}
+	return batches, nil
+}
+
+// 向agent推送一次数据, 根据状态码和返回内容判断是否成功
+// falcon agent 成功时返回 200 和 "success"
+func pushOnce(c *config.Config, body []byte, deadline time.Time) error {
+	var reader io.Reader = bytes.NewReader(body)
+	if c.Gzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return &pushError{retryable: false, msg: err.Error()}
+		}
+		if err := zw.Close(); err != nil {
+			return &pushError{retryable: false, msg: err.Error()}
+		}
+		reader = &buf
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	req, err := http.NewRequest("POST", c.Agent, reader)
+	if err != nil {
+		return &pushError{retryable: false, msg: err.Error()}
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "plain/text")
+	if c.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return &pushError{retryable: true, msg: err.Error()}
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	text := strings.TrimSpace(string(respBody))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		if text != "success" {
+			return &pushError{retryable: false, msg: fmt.Sprintf("agent status %d, body: %s", resp.StatusCode, text)}
+		}
+		return nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout:
+		return &pushError{retryable: true, msg: fmt.Sprintf("agent status %d, body: %s", resp.StatusCode, text)}
+	default:
+		return &pushError{retryable: false, msg: fmt.Sprintf("agent status %d, body: %s", resp.StatusCode, text)}
+	}
+}
+
+// 一次上报的所有批次的截止时间, 包括等待 workers 和重试在内不超过最短 timer 的 80%
+func pushDeadline(c *config.Config, now time.Time) time.Time {
+	step := c.Timer
+	for _, t := range c.Timers() {
+		if t < step {
+			step = t
+		}
+	}
+	return now.Add(time.Duration(step) * time.Second * 4 / 5)
+}
+
+// 推送数据, 可重试的错误按指数退避重试, 到 deadline 时还没有成功的数据写入dead letter文件.
+// 在 goroutine 中等待 workers, 等待和重试都不会阻塞上报的调度
+func pushToAgent(c *config.Config, body []byte, deadline time.Time) {
+	wait := time.NewTimer(time.Until(deadline))
+	select {
+	case workers <- true:
+		wait.Stop()
+	case <-wait.C:
+		atomic.AddInt64(&pushStats.Exhausted, 1)
+		log.Error("push data failed: no free worker before deadline")
+		writeDeadLetter(c, body)
+		return
+	}
+	defer func() { <-workers }()
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := pushOnce(c, body, deadline)
+		if err == nil {
+			atomic.AddInt64(&pushStats.Success, 1)
+			log.Debug("push data success")
+			return
+		}
+
+		pe := err.(*pushError)
+		if !pe.retryable {
+			atomic.AddInt64(&pushStats.Permanent, 1)
+			log.Error("push data rejected by agent, will not retry:", pe)
+			break
+		}
+		if attempt >= c.Retry || time.Now().Add(backoff).After(deadline) {
+			atomic.AddInt64(&pushStats.Exhausted, 1)
+			log.Error("push data failed after", attempt, "retries:", pe)
+			break
+		}
+
+		atomic.AddInt64(&pushStats.Retried, 1)
+		log.Warn("push data failed, retry in", backoff, ":", pe)
+		time.Sleep(backoff)
+		if backoff < time.Duration(c.Timer)*time.Second {
+			backoff *= 2
+		}
+	}
+
+	writeDeadLetter(c, body)
+}
+
+// 失败的数据以一行json的形式追加到dead letter文件
+func writeDeadLetter(c *config.Config, body []byte) {
+	if c.DeadLetter == "" {
+		atomic.AddInt64(&pushStats.Dropped, 1)
+		log.Warn("dead_letter not set, drop data:", string(body))
+		return
+	}
+
+	file, err := os.OpenFile(c.DeadLetter, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		atomic.AddInt64(&pushStats.Dropped, 1)
+		log.Error("open dead letter file", c.DeadLetter, err)
+		return
+	}
+	defer file.Close()
+
+	if _, err = file.Write(append(body, '\n')); err != nil {
+		atomic.AddInt64(&pushStats.Dropped, 1)
+		log.Error("write dead letter file", c.DeadLetter, err)
+		return
+	}
+	atomic.AddInt64(&pushStats.DeadLetter, 1)
+}
+
+// 查看推送结果计数
+func pushStatsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.Write([]byte("GET method only"))
+		return
+	}
+
+	stats := map[string]int64{
+		"success":     atomic.LoadInt64(&pushStats.Success),
+		"retried":     atomic.LoadInt64(&pushStats.Retried),
+		"permanent":   atomic.LoadInt64(&pushStats.Permanent),
+		"exhausted":   atomic.LoadInt64(&pushStats.Exhausted),
+		"dead_letter": atomic.LoadInt64(&pushStats.DeadLetter),
+		"dropped":     atomic.LoadInt64(&pushStats.Dropped),
+	}
+	result, _ := json.Marshal(stats)
+	w.Write(result)
+}
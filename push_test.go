@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"./config"
+)
+
+func TestSplitBatches(t *testing.T) {
+	data := make([]config.PushData, 7)
+	for i := range data {
+		data[i] = config.PushData{Metric: "log", Endpoint: "host", Timestamp: 1470827010, Value: float64(i), Step: 30, CounterType: "GAUGE", Tags: "tag=a"}
+	}
+	item, _ := json.Marshal(data[0])
+	// n 条数据的批次的长度: "[" + n 条数据 + n-1 个 "," + "]"
+	size := func(n int) int {
+		return n*(len(item)+1) + 1
+	}
+
+	tests := []struct {
+		name       string
+		batchSize  int
+		batchBytes int
+		want       []int
+	}{
+		{"one batch", 1000, 1024 * 1024, []int{7}},
+		{"batch size", 3, 1024 * 1024, []int{3, 3, 1}},
+		{"batch size equals count", 7, 1024 * 1024, []int{7}},
+		{"exactly fits batch bytes", 1000, size(3), []int{3, 3, 1}},
+		{"one byte less than batch bytes", 1000, size(3) - 1, []int{2, 2, 2, 1}},
+		{"one byte more than batch bytes", 1000, size(3) + 1, []int{3, 3, 1}},
+		{"batch size before batch bytes", 2, size(3), []int{2, 2, 2, 1}},
+		{"batch bytes before batch size", 5, size(2), []int{2, 2, 2, 1}},
+		{"item larger than batch bytes", 1000, 10, []int{1, 1, 1, 1, 1, 1, 1}},
+	}
+	for _, tt := range tests {
+		c := &config.Config{BatchSize: tt.batchSize, BatchBytes: tt.batchBytes}
+		batches, err := splitBatches(c, data)
+		if err != nil {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+
+		counts := make([]int, 0, len(batches))
+		all := make([]config.PushData, 0, len(data))
+		for _, b := range batches {
+			var items []config.PushData
+			if err := json.Unmarshal(b, &items); err != nil {
+				t.Errorf("%s: invalid batch %s: %v", tt.name, b, err)
+				continue
+			}
+			if len(b) > tt.batchBytes && len(items) > 1 {
+				t.Errorf("%s: batch of %d bytes exceeds batch_bytes %d", tt.name, len(b), tt.batchBytes)
+			}
+			counts = append(counts, len(items))
+			all = append(all, items...)
+		}
+		if !reflect.DeepEqual(counts, tt.want) {
+			t.Errorf("%s: batch sizes %v, want %v", tt.name, counts, tt.want)
+		}
+		if !reflect.DeepEqual(all, data) {
+			t.Errorf("%s: batches do not contain all data in order", tt.name)
+		}
+	}
+
+	c := &config.Config{BatchSize: 1000, BatchBytes: 1024 * 1024}
+	if batches, err := splitBatches(c, nil); err != nil || len(batches) != 0 {
+		t.Errorf("splitBatches(nil) = %d batches, %v, want none", len(batches), err)
+	}
+}
+
+func TestPushToAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logdog-push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	workers = make(chan bool, 1)
+
+	tests := []struct {
+		name   string
+		status []int // 每次请求返回的状态码, 最后一个一直重复
+		body   string
+		retry  int
+		first  string   // 第一次推送的结果: success retryable permanent
+		stats  [6]int64 // success retried permanent exhausted dead_letter dropped
+	}{
+		{"success", []int{200}, "success", 0, "success", [6]int64{1, 0, 0, 0, 0, 0}},
+		{"success with spaces", []int{200}, " success\n", 0, "success", [6]int64{1, 0, 0, 0, 0, 0}},
+		{"2xx without success", []int{200}, "error", 3, "permanent", [6]int64{0, 0, 1, 0, 1, 0}},
+		{"204", []int{204}, "", 3, "permanent", [6]int64{0, 0, 1, 0, 1, 0}},
+		{"400", []int{400}, "bad request", 3, "permanent", [6]int64{0, 0, 1, 0, 1, 0}},
+		{"404", []int{404}, "", 3, "permanent", [6]int64{0, 0, 1, 0, 1, 0}},
+		{"500", []int{500}, "", 0, "retryable", [6]int64{0, 0, 0, 1, 1, 0}},
+		{"503", []int{503}, "", 0, "retryable", [6]int64{0, 0, 0, 1, 1, 0}},
+		{"408", []int{408}, "", 0, "retryable", [6]int64{0, 0, 0, 1, 1, 0}},
+		{"429", []int{429}, "", 0, "retryable", [6]int64{0, 0, 0, 1, 1, 0}},
+		{"retry then success", []int{503, 200}, "success", 1, "retryable", [6]int64{1, 1, 0, 0, 0, 0}},
+		{"retries exhausted", []int{503}, "", 1, "retryable", [6]int64{0, 1, 0, 1, 1, 0}},
+	}
+	for _, tt := range tests {
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			n := int(atomic.AddInt32(&requests, 1)) - 1
+			if n >= len(tt.status) {
+				n = len(tt.status) - 1
+			}
+			w.WriteHeader(tt.status[n])
+			w.Write([]byte(tt.body))
+		}))
+
+		deadLetter := filepath.Join(dir, tt.name+".jsonl")
+		c := &config.Config{Agent: server.URL, Timer: 30, Retry: tt.retry, DeadLetter: deadLetter}
+		body := []byte(`[{"metric":"log"}]`)
+
+		first := "success"
+		if err := pushOnce(c, body, time.Now().Add(10*time.Second)); err != nil {
+			first = "permanent"
+			if err.(*pushError).retryable {
+				first = "retryable"
+			}
+		}
+		if first != tt.first {
+			t.Errorf("%s: pushOnce() is %s, want %s", tt.name, first, tt.first)
+		}
+
+		atomic.StoreInt32(&requests, 0)
+		pushStats.Success, pushStats.Retried, pushStats.Permanent = 0, 0, 0
+		pushStats.Exhausted, pushStats.DeadLetter, pushStats.Dropped = 0, 0, 0
+		pushToAgent(c, body, pushDeadline(c, time.Now()))
+		server.Close()
+
+		stats := [6]int64{pushStats.Success, pushStats.Retried, pushStats.Permanent,
+			pushStats.Exhausted, pushStats.DeadLetter, pushStats.Dropped}
+		if stats != tt.stats {
+			t.Errorf("%s: stats = %v, want %v", tt.name, stats, tt.stats)
+		}
+		data, _ := ioutil.ReadFile(deadLetter)
+		if want := strings.Repeat(string(body)+"\n", int(tt.stats[4])); string(data) != want {
+			t.Errorf("%s: dead letter = %q, want %q", tt.name, data, want)
+		}
+	}
+
+	// 没有设置 dead_letter 时直接丢弃
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(400)
+	}))
+	defer server.Close()
+	pushStats.Dropped = 0
+	c := &config.Config{Agent: server.URL, Timer: 30}
+	pushToAgent(c, []byte("[]"), pushDeadline(c, time.Now()))
+	if pushStats.Dropped != 1 {
+		t.Errorf("dropped = %d, want 1", pushStats.Dropped)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"./config"
+)
+
+func TestChangedSeries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logdog-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// file 是文件的其它配置, keywords 是关键词的列表
+	load := func(file string, keywords string) *config.WatchFile {
+		cfg := `{"timer":30,"agent":"http://127.0.0.1:1988","host":"h","files":[{"path":"` + dir + `","filepattern":"log"` + file + `,"keywords":[` + keywords + `]}]}`
+		var c config.Config
+		if err := json.Unmarshal([]byte(cfg), &c); err != nil {
+			t.Fatal(err)
+		}
+		if err := config.CheckConfig(&c); err != nil {
+			t.Fatal(err)
+		}
+		return c.WatchFiles[0]
+	}
+	a := `{"exp":"a","tag":"a"}`
+	b := `{"exp":"b ([0-9]+)","tag":"b","type":"sum"}`
+	m := `{"exp":"m ([0-9]+)","tag":"m","types":["count","max"]}`
+	k := `{"exp":"k (.*)","tag":"k","type":"topk"}`
+	old := load("", strings.Join([]string{a, b, m, k}, ","))
+
+	tests := []struct {
+		name     string
+		file     string
+		keywords []string
+		want     []string
+	}{
+		{"unchanged", "", []string{a, b, m, k}, nil},
+		{"keyword order", "", []string{k, m, b, a}, nil},
+		{"keyword added", "", []string{a, b, m, k, `{"exp":"c","tag":"c"}`}, nil},
+		{"keyword removed", "", []string{a, m, k}, []string{"b"}},
+		{"exp changed", "", []string{`{"exp":"aa","tag":"a"}`, b, m, k}, []string{"a"}},
+		{"type changed", "", []string{a, `{"exp":"b ([0-9]+)","tag":"b","type":"max"}`, m, k}, []string{"b"}},
+		{"type added", "", []string{a, b, `{"exp":"m ([0-9]+)","tag":"m","types":["count","max","min"]}`, k}, nil},
+		{"type removed", "", []string{a, b, `{"exp":"m ([0-9]+)","tag":"m","types":["count"]}`, k}, []string{"m.max"}},
+		{"counter type", "", []string{`{"exp":"a","tag":"a","counter_type":"COUNTER"}`, b, m, k}, []string{"a"}},
+		{"keyword metric", "", []string{a, `{"exp":"b ([0-9]+)","tag":"b","type":"sum","metric":"x"}`, m, k}, []string{"b"}},
+		{"keyword tags", "", []string{`{"exp":"a","tag":"a","tags":{"k":"v"}}`, b, m, k}, []string{"a"}},
+		{"topk capacity", "", []string{a, b, m, `{"exp":"k (.*)","tag":"k","type":"topk","topk_capacity":500}`}, []string{"k"}},
+		{"keyword timer", "", []string{`{"exp":"a","tag":"a","timer":60}`, b, m, k}, nil},
+		{"file timer", `,"timer":60`, []string{a, b, m, k}, nil},
+		{"file metric", `,"metric":"x"`, []string{a, b, m, k}, []string{"a", "b", "k", "m.count", "m.max"}},
+		{"drop path tags", `,"drop_path_tags":true`, []string{a, b, m, k}, []string{"a", "b", "k", "m.count", "m.max"}},
+	}
+	for _, tt := range tests {
+		got := changedSeries(old, load(tt.file, strings.Join(tt.keywords, ",")))
+		sort.Strings(got)
+		if len(got) == 0 {
+			got = nil
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: changedSeries() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"./config"
+)
+
+// 样本中每行的最大长度
+const sampleMaxLength = 1024
+
+// 最近匹配到关键词的日志行
+type lineSample struct {
+	Time        time.Time `json:"time"`
+	Path        string    `json:"path"`
+	FilePattern string    `json:"filepattern"`
+	Line        string    `json:"line"`
+}
+
+// 环形缓冲区, 只保留最近的 len(lines) 行
+type sampleRing struct {
+	tag   string
+	lines []lineSample
+	next  int
+	full  bool
+}
+
+var (
+	samples     = make(map[string]*sampleRing)
+	samplesLock sync.RWMutex
+)
+
+// 匹配到关键词时调用, 记录样本并按照 capture 配置输出
+func matchedLine(file config.WatchFile, p config.KeyWord, line string) {
+	recordSample(file, p.Tag, line)
+	captureLine(file, p, line)
+}
+
+// 截断到最多 max 个字节, 不截断多字节的字符(比如中文), 避免输出的 json 中出现乱码
+func truncateLine(line string, max int) string {
+	if len(line) <= max {
+		return line
+	}
+	for max > 0 && !utf8.RuneStart(line[max]) {
+		max--
+	}
+	return line[:max]
+}
+
+func recordSample(file config.WatchFile, tag string, line string) {
+	size := config.Cfg.Samples
+	if size <= 0 {
+		return
+	}
+	line = truncateLine(line, sampleMaxLength)
+
+	key := file.Path + file.FilePattern + tag
+	samplesLock.Lock()
+	defer samplesLock.Unlock()
+	ring, ok := samples[key]
+	// 配置热更新后缓冲区大小可能变化
+	if !ok || len(ring.lines) != size {
+		ring = &sampleRing{tag: tag, lines: make([]lineSample, size)}
+		samples[key] = ring
+	}
+	ring.lines[ring.next] = lineSample{Time: time.Now(), Path: file.Path, FilePattern: file.FilePattern, Line: line}
+	ring.next++
+	if ring.next == len(ring.lines) {
+		ring.next = 0
+		ring.full = true
+	}
+}
+
+// 按时间先后返回缓冲区中的日志行
+func (r *sampleRing) items() []lineSample {
+	if !r.full {
+		return append([]lineSample(nil), r.lines[:r.next]...)
+	}
+	return append(append([]lineSample(nil), r.lines[r.next:]...), r.lines[:r.next]...)
+}
+
+// GET /keywords/{tag}/samples?n=50 返回该tag最近匹配到的n行, 多个文件有相同tag时合并后按时间排序
+func samplesHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.Write([]byte("GET method only"))
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/keywords/"), "/"), "/")
+	if len(parts) != 2 || parts[1] != "samples" || parts[0] == "" {
+		http.NotFound(w, req)
+		return
+	}
+	tag := parts[0]
+
+	n := 0
+	if v := req.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 {
+			http.Error(w, "n must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	found := false
+	result := make([]lineSample, 0)
+	samplesLock.RLock()
+	for _, ring := range samples {
+		if ring.tag == tag {
+			found = true
+			result = append(result, ring.items()...)
+		}
+	}
+	samplesLock.RUnlock()
+	if !found {
+		http.Error(w, "no samples for tag "+tag, http.StatusNotFound)
+		return
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Time.Before(result[j].Time)
+	})
+	if n > 0 && len(result) > n {
+		result = result[len(result)-n:]
+	}
+
+	bytes, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateLine(t *testing.T) {
+	tests := []struct {
+		line string
+		max  int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exact", 5, "exact"},
+		{"abcdef", 3, "abc"},
+		{"错误日志", 12, "错误日志"},
+		{"错误日志", 6, "错误"},
+		{"错误日志", 7, "错误"},
+		{"错误日志", 8, "错误"},
+		{"错误日志", 2, ""},
+		{"a错误", 2, "a"},
+		{"a错误", 4, "a错"},
+	}
+	for _, tt := range tests {
+		got := truncateLine(tt.line, tt.max)
+		if got != tt.want || !utf8.ValidString(got) {
+			t.Errorf("truncateLine(%q, %d) = %q, want %q", tt.line, tt.max, got, tt.want)
+		}
+	}
+}
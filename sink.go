@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"./config"
+	"./log"
+)
+
+// 本地文件输出, 按大小滚动
+type fileSink struct {
+	sync.Mutex
+	path string
+	file *os.File
+	size int64
+}
+
+var metricSink = &fileSink{}
+
+// 把每条数据以 json 行或 csv 行的形式追加到本地文件
+func writeFileSink(c *config.Config, data []config.PushData) {
+	if c.FileSink == nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	switch c.FileSink.Format {
+	case "csv":
+		w := csv.NewWriter(&buf)
+		for _, d := range data {
+			w.Write([]string{d.Metric, d.Endpoint, strconv.FormatInt(d.Timestamp, 10),
+				strconv.FormatFloat(d.Value, 'f', -1, 64), strconv.Itoa(d.Step), d.CounterType, d.Tags})
+		}
+		w.Flush()
+	default:
+		for _, d := range data {
+			line, err := json.Marshal(d)
+			if err != nil {
+				log.Error("marshal file sink data", d, err)
+				continue
+			}
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+	}
+
+	if err := metricSink.write(c.FileSink, buf.Bytes()); err != nil {
+		log.Error("write file sink", c.FileSink.Path, err)
+	}
+}
+
+func (s *fileSink) write(cfg *config.FileSink, b []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	// 配置热更新后文件路径可能变化
+	if s.file != nil && s.path != cfg.Path {
+		s.file.Close()
+		s.file = nil
+	}
+	if s.file == nil {
+		if err := s.open(cfg.Path); err != nil {
+			return err
+		}
+	}
+
+	if cfg.MaxSize > 0 && s.size > 0 && s.size+int64(len(b)) > cfg.MaxSize {
+		if err := s.rotate(cfg); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(b)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileSink) open(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.path = path
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// path.1 是最近一次滚动的文件, 超过 max_backups 的文件会被删除
+func (s *fileSink) rotate(cfg *config.FileSink) error {
+	s.file.Close()
+	s.file = nil
+
+	if cfg.MaxBackups <= 0 {
+		if err := os.Remove(cfg.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", cfg.Path, cfg.MaxBackups))
+		for i := cfg.MaxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", cfg.Path, i), fmt.Sprintf("%s.%d", cfg.Path, i+1))
+		}
+		if err := os.Rename(cfg.Path, cfg.Path+".1"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	log.Info("file sink rotated:", cfg.Path)
+	return s.open(cfg.Path)
+}
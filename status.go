@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"./config"
+)
+
+// 监控文件的状态, pending 表示 path 还不存在, idle 表示目录中还没有匹配的日志文件
+type watchStatus struct {
+	Path        string `json:"path"`
+	FilePattern string `json:"filepattern"`
+	State       string `json:"state"`
+	File        string `json:"file"`
+}
+
+// GET /status 返回版本和每个监控文件的状态
+func statusHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.Write([]byte("GET method only"))
+		return
+	}
+
+	files := make([]watchStatus, 0, len(config.Cfg.WatchFiles))
+	for _, v := range config.Cfg.WatchFiles {
+		s := watchStatus{Path: v.Path, FilePattern: v.FilePattern, File: v.ResultFile.FileName}
+		switch {
+		case v.IsPending():
+			s.State = "pending"
+		case v.ResultFile.FileName == "":
+			s.State = "idle"
+		default:
+			s.State = "watching"
+		}
+		files = append(files, s)
+	}
+
+	bytes, _ := json.Marshal(map[string]interface{}{"version": VERSION, "files": files})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
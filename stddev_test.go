@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/streamrail/concurrent-map"
+
+	"./config"
+)
+
+func TestStddevVariance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logdog-stddev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var c config.Config
+	cfg := `{"timer":30,"agent":"http://127.0.0.1:1988","host":"h","samples":-1,"files":[{"path":"` + dir + `","filepattern":"log",
+		"keywords":[{"exp":"v=([-0-9.e+]+)","tag":"var","type":"variance"},{"exp":"v=([-0-9.e+]+)","tag":"std","type":"stddev"}]}]}`
+	if err := json.Unmarshal([]byte(cfg), &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.CheckConfig(&c); err != nil {
+		t.Fatal(err)
+	}
+	config.Cfg = &c
+	file := c.WatchFiles[0]
+
+	tests := []struct {
+		name     string
+		values   []float64
+		variance float64
+	}{
+		{"one value", []float64{5}, 0},
+		{"constant", []float64{3, 3, 3}, 0},
+		{"population variance", []float64{2, 4, 4, 4, 5, 5, 7, 9}, 4},
+		{"negative", []float64{-1, 1}, 1},
+		// 数值很大时直接用平方和计算会丢失精度
+		{"large offset", []float64{1e9 + 4, 1e9 + 7, 1e9 + 13, 1e9 + 16}, 22.5},
+	}
+	for _, tt := range tests {
+		keywords = cmap.New()
+		for _, v := range tt.values {
+			handleKeywords(*file, fmt.Sprintf("v=%v", v))
+		}
+		for tag, want := range map[string]float64{"var": tt.variance, "std": math.Sqrt(tt.variance)} {
+			d, ok := keywords.Get(file.Path + file.FilePattern + tag)
+			if !ok {
+				t.Errorf("%s: %s not found", tt.name, tag)
+				continue
+			}
+			if got := d.(config.PushData).Value; math.Abs(got-want) > 1e-9*math.Max(1, want) {
+				t.Errorf("%s: %s = %v, want %v", tt.name, tag, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"./config"
+)
+
+// space-saving 算法中的一个计数器, err 是计数可能多算的上限
+type topkCounter struct {
+	value string
+	count int64
+	err   int64
+}
+
+// topk 类型关键词本周期的 space-saving 草图, 最多保留 capacity 个计数器
+type topkSketch struct {
+	k        int
+	capacity int
+	counters map[string]*topkCounter
+}
+
+var (
+	topkSketches = make(map[string]*topkSketch)
+	topkLock     sync.Mutex
+)
+
+// tag 的值中不能有逗号和等号
+var tagValueReplacer = strings.NewReplacer(",", "_", "=", "_", " ", "_")
+
+func addTopK(key string, value string, k int, capacity int) {
+	topkLock.Lock()
+	defer topkLock.Unlock()
+
+	sketch, ok := topkSketches[key]
+	if !ok {
+		sketch = &topkSketch{k: k, capacity: capacity, counters: make(map[string]*topkCounter)}
+		topkSketches[key] = sketch
+	}
+
+	if c, ok := sketch.counters[value]; ok {
+		c.count++
+		return
+	}
+	if len(sketch.counters) < sketch.capacity {
+		sketch.counters[value] = &topkCounter{value: value, count: 1}
+		return
+	}
+
+	// 满了以后替换计数最小的值, 新值继承它的计数
+	var min *topkCounter
+	for _, c := range sketch.counters {
+		if min == nil || c.count < min.count {
+			min = c
+		}
+	}
+	delete(sketch.counters, min.value)
+	sketch.counters[value] = &topkCounter{value: value, count: min.count + 1, err: min.count}
+}
+
+// 上报时取出计数最多的k个值并清空, 每个值是一条数据, tags 加上 rank 和 value
+func popTopK(key string, base config.PushData) []config.PushData {
+	topkLock.Lock()
+	sketch, ok := topkSketches[key]
+	delete(topkSketches, key)
+	topkLock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	counters := make([]*topkCounter, 0, len(sketch.counters))
+	for _, c := range sketch.counters {
+		counters = append(counters, c)
+	}
+	sort.Slice(counters, func(i, j int) bool {
+		if counters[i].count != counters[j].count {
+			return counters[i].count > counters[j].count
+		}
+		return counters[i].value < counters[j].value
+	})
+	if len(counters) > sketch.k {
+		counters = counters[:sketch.k]
+	}
+
+	data := make([]config.PushData, 0, len(counters))
+	for i, c := range counters {
+		d := base
+		d.Value = float64(c.count)
+		d.Tags = base.Tags + ",rank=" + strconv.Itoa(i+1) + ",value=" + tagValueReplacer.Replace(c.value)
+		data = append(data, d)
+	}
+	return data
+}
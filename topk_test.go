@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"./config"
+)
+
+func TestTopK(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []string
+		k        int
+		capacity int
+		want     []string
+	}{
+		{
+			name:     "empty",
+			k:        3,
+			capacity: 30,
+		},
+		{
+			name:     "fewer than k",
+			values:   []string{"a", "b", "a"},
+			k:        3,
+			capacity: 30,
+			want:     []string{"rank=1,value=a 2", "rank=2,value=b 1"},
+		},
+		{
+			name:     "ties sorted by value",
+			values:   []string{"c", "b", "a", "c", "b", "a", "d"},
+			k:        2,
+			capacity: 30,
+			want:     []string{"rank=1,value=a 2", "rank=2,value=b 2"},
+		},
+		{
+			name:     "value escaped in tags",
+			values:   []string{"a,b=c d"},
+			k:        1,
+			capacity: 10,
+			want:     []string{"rank=1,value=a_b_c_d 1"},
+		},
+		{
+			// 满了以后新值替换计数最小的值并继承它的计数, 频繁的值不会被挤掉
+			name:     "over capacity",
+			values:   []string{"a", "a", "a", "a", "b", "b", "b", "b", "c", "d", "e", "a", "f", "b"},
+			k:        2,
+			capacity: 3,
+			want:     []string{"rank=1,value=a 5", "rank=2,value=b 5"},
+		},
+		{
+			// 新值继承被替换的值的计数, 计数可能多算
+			name:     "replaced counter inherits count",
+			values:   []string{"a", "a", "b", "c"},
+			k:        2,
+			capacity: 2,
+			want:     []string{"rank=1,value=a 2", "rank=2,value=c 2"},
+		},
+	}
+	for _, tt := range tests {
+		key := "test" + tt.name
+		for _, v := range tt.values {
+			addTopK(key, v, tt.k, tt.capacity)
+		}
+		base := config.PushData{Metric: "log", Tags: "tag=t"}
+		var got []string
+		for _, d := range popTopK(key, base) {
+			if d.Metric != base.Metric {
+				t.Errorf("%s: metric = %q, want %q", tt.name, d.Metric, base.Metric)
+			}
+			got = append(got, d.Tags[len(base.Tags)+1:]+" "+strconv.FormatFloat(d.Value, 'f', -1, 64))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: topk = %v, want %v", tt.name, got, tt.want)
+		}
+		// 上报后清空, 下个周期重新计数
+		if d := popTopK(key, base); d != nil {
+			t.Errorf("%s: topk after pop = %v, want nil", tt.name, d)
+		}
+	}
+}